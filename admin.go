@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"./db"
+	"./rollbar"
+)
+
+// printListing prints rows as a table under header, or value as JSON if asJSON is set
+func printListing(asJSON bool, value interface{}, header []string, rows [][]string) {
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(value)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseListingFlags parses the flags of a command printing a listing, and returns its arguments
+func parseListingFlags(name string, args []string) (bool, []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	return *asJSON, flags.Args()
+}
+
+func usageError() {
+	fmt.Fprint(os.Stderr, commandsUsage)
+	os.Exit(2)
+}
+
+type teamListing struct {
+	Team          string   `json:"team"`
+	BotToken      bool     `json:"bot_token"`
+	UserTokens    int      `json:"user_tokens"`
+	FailingTokens int      `json:"failing_tokens"`
+	Projects      []string `json:"projects"`
+}
+
+// listTeams describes the installed teams and their tokens
+func listTeams(store db.Store) []teamListing {
+	listings := []teamListing{}
+	for _, team := range store.GetTeams() {
+		listing := teamListing{Team: team, Projects: store.GetProjects(team)}
+		for _, token := range store.GetAuthTokens(team) {
+			if token.Owner == db.BotTokenOwner {
+				listing.BotToken = true
+			} else {
+				listing.UserTokens++
+			}
+			if token.Failing() {
+				listing.FailingTokens++
+			}
+		}
+		if listing.Projects == nil {
+			listing.Projects = []string{}
+		}
+		listings = append(listings, listing)
+	}
+	return listings
+}
+
+func teamsCommand(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		usageError()
+	}
+	asJSON, _ := parseListingFlags("teams list", args[1:])
+
+	var listings []teamListing
+	if !fetchListing("/admin/teams", nil, &listings) {
+		store := openStore(db.Options{ReadOnly: true})
+		defer store.Close()
+		listings = listTeams(store)
+	}
+
+	var rows [][]string
+	for _, listing := range listings {
+		rows = append(rows, []string{
+			listing.Team,
+			yesNo(listing.BotToken),
+			strconv.Itoa(listing.UserTokens),
+			strconv.Itoa(listing.FailingTokens),
+			strings.Join(listing.Projects, ", "),
+		})
+	}
+	printListing(asJSON, listings, []string{"TEAM", "BOT TOKEN", "USER TOKENS", "FAILING", "PROJECTS"}, rows)
+}
+
+type projectListing struct {
+	Project string `json:"project"`
+	// 0 if it couldn't be verified when the token was set
+	ProjectID  int    `json:"project_id"`
+	WriteToken bool   `json:"write_token"`
+	SetBy      string `json:"set_by"`
+	// when the read token was last checked in the background, and whether it failed
+	LastChecked time.Time `json:"last_checked"`
+	Failing     bool      `json:"failing"`
+}
+
+// listProjects describes the Rollbar projects of a team
+func listProjects(store db.Store, team string) []projectListing {
+	listings := []projectListing{}
+	for _, project := range store.GetProjects(team) {
+		status := store.GetProjectTokenStatus(team, project, false)
+		listings = append(listings, projectListing{
+			Project:     project,
+			ProjectID:   status.ProjectID,
+			WriteToken:  store.GetProjectWriteToken(team, project) != "",
+			SetBy:       status.SetBy,
+			LastChecked: status.LastChecked,
+			Failing:     status.Failing(),
+		})
+	}
+	return listings
+}
+
+func projectsCommand(args []string) {
+	if len(args) == 0 {
+		usageError()
+	}
+	switch args[0] {
+	case "list":
+		asJSON, rest := parseListingFlags("projects list", args[1:])
+		if len(rest) != 1 {
+			usageError()
+		}
+		team := rest[0]
+
+		var listings []projectListing
+		if !fetchListing("/admin/projects", url.Values{"team": {team}}, &listings) {
+			store := openStore(db.Options{ReadOnly: true})
+			defer store.Close()
+			listings = listProjects(store, team)
+		}
+
+		var rows [][]string
+		for _, listing := range listings {
+			projectID := "unverified"
+			if listing.ProjectID != 0 {
+				projectID = strconv.Itoa(listing.ProjectID)
+			}
+			lastChecked := "never"
+			if !listing.LastChecked.IsZero() {
+				lastChecked = listing.LastChecked.UTC().Format(time.RFC3339)
+			}
+			rows = append(rows, []string{listing.Project, projectID, yesNo(listing.WriteToken), listing.SetBy, lastChecked, yesNo(listing.Failing)})
+		}
+		printListing(asJSON, listings, []string{"PROJECT", "ROLLBAR ID", "WRITE TOKEN", "SET BY", "LAST CHECKED", "FAILING"}, rows)
+	case "remove":
+		if len(args) != 3 {
+			usageError()
+		}
+		team, project := args[1], strings.ToLower(args[2])
+
+		store := openStore(db.Options{})
+		defer store.Close()
+
+		if store.GetProjectToken(team, project) == "" {
+			fmt.Fprintf(os.Stderr, "Project %s is not configured for team %s\n", project, team)
+			store.Close()
+			os.Exit(1)
+		}
+		store.DeleteProjectToken(team, project)
+		fmt.Printf("Removed project %s of team %s\n", project, team)
+	default:
+		usageError()
+	}
+}
+
+type tokenCheck struct {
+	Team    string `json:"team"`
+	Project string `json:"project"`
+	Token   string `json:"token"`
+	Valid   bool   `json:"valid"`
+	Error   string `json:"error,omitempty"`
+}
+
+// verifyTokens checks the stored Rollbar tokens of teams against the Rollbar API
+func verifyTokens(ctx context.Context, store db.Store, client *rollbar.Client, teams []string) []tokenCheck {
+	checks := []tokenCheck{}
+	for _, team := range teams {
+		for _, project := range store.GetProjects(team) {
+			tokens := []struct {
+				kind, token string
+				write       bool
+			}{
+				{"read", store.GetProjectToken(team, project), false},
+				{"write", store.GetProjectWriteToken(team, project), true},
+			}
+			for _, t := range tokens {
+				if t.token == "" {
+					continue
+				}
+				check := tokenCheck{Team: team, Project: project, Token: t.kind, Valid: true}
+				projectID := store.GetProjectTokenStatus(team, project, t.write).ProjectID
+				if err := checkProjectToken(ctx, client, t.token, projectID, t.write); err != nil {
+					check.Valid, check.Error = false, err.Error()
+				}
+				checks = append(checks, check)
+			}
+		}
+	}
+	return checks
+}
+
+// tokensCommand checks the stored Rollbar tokens against the Rollbar API. It exits with
+// status 1 if any token is invalid. Pointed at the running app with UNFURLER_ADMIN_URL,
+// it can be used for monitoring.
+func tokensCommand(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		usageError()
+	}
+	asJSON, teams := parseListingFlags("tokens verify", args[1:])
+
+	var checks []tokenCheck
+	if !fetchListing("/admin/tokens/verify", url.Values{"team": teams}, &checks) {
+		store := openStore(db.Options{ReadOnly: true})
+		defer store.Close()
+		if len(teams) == 0 {
+			teams = store.GetTeams()
+		}
+		client := rollbar.NewClient()
+		if rollbarURL := os.Getenv("UNFURLER_ROLLBAR_URL"); rollbarURL != "" {
+			client.BaseURL = rollbarURL
+		}
+		checks = verifyTokens(context.Background(), store, client, teams)
+	}
+
+	var rows [][]string
+	allValid := true
+	for _, check := range checks {
+		allValid = allValid && check.Valid
+		rows = append(rows, []string{check.Team, check.Project, check.Token, yesNo(check.Valid), check.Error})
+	}
+	printListing(asJSON, checks, []string{"TEAM", "PROJECT", "TOKEN", "VALID", "ERROR"}, rows)
+	if !allValid {
+		os.Exit(1)
+	}
+}
+
+// fetchListing gets a listing from the admin endpoints of the running app at UNFURLER_ADMIN_URL
+// into result. It returns false if no URL is set, in which case the listing is read from the
+// database, which only works with the app stopped.
+func fetchListing(path string, query url.Values, result interface{}) bool {
+	adminURL := os.Getenv("UNFURLER_ADMIN_URL")
+	if adminURL == "" {
+		return false
+	}
+	token := os.Getenv("UNFURLER_ADMIN_TOKEN")
+	if token == "" {
+		log.Fatal("UNFURLER_ADMIN_TOKEN is not set, but UNFURLER_ADMIN_URL is")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(adminURL, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		log.Fatalf("Invalid UNFURLER_ADMIN_URL: %s", err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Could not reach the app: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("The app responded with %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		log.Fatalf("Could not decode the response of the app: %s", err.Error())
+	}
+	return true
+}
+
+// writeListing responds to an admin request with a listing
+func writeListing(w http.ResponseWriter, listing interface{}) {
+	b, err := json.Marshal(listing)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (s *server) teamsHandler(w http.ResponseWriter, r *http.Request) {
+	writeListing(w, listTeams(s.store))
+}
+
+func (s *server) projectsHandler(w http.ResponseWriter, r *http.Request) {
+	team := r.FormValue("team")
+	if team == "" {
+		http.Error(w, "team is required", 400)
+		return
+	}
+	writeListing(w, listProjects(s.store, team))
+}
+
+func (s *server) verifyTokensHandler(w http.ResponseWriter, r *http.Request) {
+	teams := r.URL.Query()["team"]
+	if len(teams) == 0 {
+		teams = s.store.GetTeams()
+	}
+	writeListing(w, verifyTokens(r.Context(), s.store, s.rollbar, teams))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"./rollbar"
+)
+
+func TestAdminListings(t *testing.T) {
+	s, store := newTestServer(t, map[string]rollbar.Project{"good": {ID: 42, Name: "MyProject"}})
+	store.SaveProjectToken("T1", "myorg/myproject", "good", "U1", 42)
+
+	var teams []teamListing
+	adminGet(t, s.teamsHandler, "/admin/teams", &teams)
+	if len(teams) != 1 || teams[0].Team != "T1" || !teams[0].BotToken || len(teams[0].Projects) != 1 {
+		t.Errorf("teams = %+v", teams)
+	}
+
+	var projects []projectListing
+	adminGet(t, s.projectsHandler, "/admin/projects?team=T1", &projects)
+	if len(projects) != 1 || projects[0].ProjectID != 42 || projects[0].SetBy != "U1" {
+		t.Errorf("projects = %+v", projects)
+	}
+
+	var checks []tokenCheck
+	adminGet(t, s.verifyTokensHandler, "/admin/tokens/verify", &checks)
+	if len(checks) != 1 || !checks[0].Valid {
+		t.Errorf("token checks = %+v", checks)
+	}
+}
+
+func adminGet(t *testing.T, handler http.HandlerFunc, path string, result interface{}) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d", path, w.Code)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatalf("GET %s: %s", path, err.Error())
+	}
+}
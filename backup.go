@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"./db"
+)
+
+const (
+	backupFilePrefix = "unfurler-"
+	backupFileSuffix = ".db"
+	// sorts in chronological order
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// requireAdmin wraps an admin endpoint. Requests have to carry the admin token as a bearer
+// token. Admin endpoints don't exist unless an admin token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			log.Printf("Rejected unauthenticated request at %s", r.URL.Path)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// backupHandler streams a consistent copy of the database
+func (s *server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backupFileName(time.Now())))
+	n, err := s.store.Backup(w)
+	if err != nil {
+		// the status has been sent already if anything was written, the client sees a truncated file
+		log.Printf("Backup failed after %d bytes: %s", n, err.Error())
+		if n == 0 {
+			http.Error(w, "Backup failed", 500)
+		}
+		return
+	}
+	log.Printf("Streamed a backup of %d bytes", n)
+}
+
+func backupFileName(t time.Time) string {
+	return backupFilePrefix + t.UTC().Format(backupTimeFormat) + backupFileSuffix
+}
+
+// scheduleBackups writes a backup to the backup directory every interval and removes the oldest
+// ones, keeping retention backups. The first backup is due interval after the latest one in the
+// directory, so restarts don't put it off. It returns once quit is closed.
+func (s *server) scheduleBackups(dir string, interval time.Duration, retention int, quit <-chan struct{}) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Could not create the backup directory: %s", err.Error())
+	}
+	var next time.Time
+	if backups, err := listBackups(dir); err == nil && len(backups) > 0 {
+		latest := strings.TrimSuffix(strings.TrimPrefix(backups[len(backups)-1], backupFilePrefix), backupFileSuffix)
+		if t, err := time.Parse(backupTimeFormat, latest); err == nil {
+			next = t.Add(interval)
+		}
+	}
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			if err := s.writeBackup(dir, retention); err != nil {
+				log.Printf("Scheduled backup failed: %s", err.Error())
+			}
+			next = time.Now().Add(interval)
+		case <-quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (s *server) writeBackup(dir string, retention int) error {
+	path := filepath.Join(dir, backupFileName(time.Now()))
+	err := db.WriteFileAtomically(path, func(w io.Writer) error {
+		_, err := s.store.Backup(w)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Backed up the database to %s", path)
+	return pruneBackups(dir, retention)
+}
+
+// listBackups returns the names of the backups in dir, oldest first
+func listBackups(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), backupFilePrefix) && strings.HasSuffix(f.Name(), backupFileSuffix) {
+			backups = append(backups, f.Name())
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// pruneBackups removes all but the newest retention backups in dir
+func pruneBackups(dir string, retention int) error {
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= retention {
+		return nil
+	}
+	for _, name := range backups[:len(backups)-retention] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		log.Printf("Removed old backup %s", name)
+	}
+	return nil
+}
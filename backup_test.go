@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"./db"
+)
+
+func newBoltTestServer(t *testing.T) (*server, string) {
+	dir, err := ioutil.TempDir("", "unfurler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := db.Open(filepath.Join(dir, "test.db"), db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return newServer(store), dir
+}
+
+// runBackups runs the backup schedule for a while and returns the backups it left
+func runBackups(t *testing.T, s *server, dir string, retention int) []string {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.scheduleBackups(dir, time.Hour, retention, quit)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(quit)
+	<-done
+	backups, err := listBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+func TestScheduledBackupIsDueOnStart(t *testing.T) {
+	s, dir := newBoltTestServer(t)
+	backupDir := filepath.Join(dir, "backups")
+	if backups := runBackups(t, s, backupDir, 7); len(backups) != 1 {
+		t.Fatalf("backups after the first start = %v, want one", backups)
+	}
+	//the backup that was just written isn't due again
+	if backups := runBackups(t, s, backupDir, 7); len(backups) != 1 {
+		t.Errorf("backups after a restart = %v, want one", backups)
+	}
+}
+
+func TestOldBackupsArePruned(t *testing.T) {
+	s, dir := newBoltTestServer(t)
+	old := time.Now().Add(-48 * time.Hour)
+	for i := 0; i < 3; i++ {
+		name := backupFileName(old.Add(time.Duration(i) * time.Minute))
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+	}
+	backups := runBackups(t, s, dir, 2)
+	if len(backups) != 2 || backups[0] != backupFileName(old.Add(2*time.Minute)) {
+		t.Errorf("backups = %v, want the newest old one and a new one", backups)
+	}
+}
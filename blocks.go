@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"./rollbar"
+)
+
+const (
+	slackHeaderMaxLength  = 150
+	slackSectionMaxLength = 3000
+	slackSectionMaxFields = 10
+	slackButtonMaxValue   = 2000
+)
+
+type slackBlockUnfurl struct {
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string        `json:"type"`
+	BlockID  string        `json:"block_id,omitempty"`
+	Text     *slackText    `json:"text,omitempty"`
+	Fields   []slackText   `json:"fields,omitempty"`
+	Elements []interface{} `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func plainText(text string) *slackText {
+	return &slackText{Type: "plain_text", Text: text}
+}
+
+func mrkdwnText(text string) *slackText {
+	return &slackText{Type: "mrkdwn", Text: text}
+}
+
+// mrkdwnField is a field showing value as it is, e.g. text coming from Rollbar
+func mrkdwnField(title, value string) slackText {
+	return formattedField(title, escapeMrkdwn(value))
+}
+
+// formattedField is a field whose value is already mrkdwn
+func formattedField(title, value string) slackText {
+	return slackText{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%s", title, value)}
+}
+
+// escapeMrkdwn escapes the characters that have a special meaning in Slack messages, so that
+// e.g. an error message can't mention @channel or disguise a link
+func escapeMrkdwn(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// itemTitle is what to call an item in a header, Slack refuses a header without text
+func itemTitle(item *rollbar.Item) string {
+	if strings.TrimSpace(item.Title) == "" {
+		return fmt.Sprintf("#%d", item.Counter)
+	}
+	return item.Title
+}
+
+// truncate shortens s to at most max runes, marking the cut with an ellipsis
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+type slackButton struct {
+	Type     string     `json:"type"`
+	Text     *slackText `json:"text"`
+	ActionID string     `json:"action_id"`
+	Value    string     `json:"value,omitempty"`
+	Style    string     `json:"style,omitempty"`
+}
+
+func button(text, actionID, value, style string) slackButton {
+	return slackButton{
+		Type:     "button",
+		Text:     plainText(text),
+		ActionID: actionID,
+		Value:    value,
+		Style:    style,
+	}
+}
+
+type slackUserSelect struct {
+	Type        string     `json:"type"`
+	Placeholder *slackText `json:"placeholder"`
+	ActionID    string     `json:"action_id"`
+	InitialUser string     `json:"initial_user,omitempty"`
+}
+
+func getUnfurlBlocks(unfurl *itemUnfurl) slackBlockUnfurl {
+	item := unfurl.Item
+	occurrence := unfurl.Occurrence
+	now := time.Now()
+	lastSeenAgo := now.Sub(time.Unix(int64(item.LastOccurrenceTimestamp), 0))
+
+	blocks := []slackBlock{
+		{
+			Type: "header",
+			Text: plainText(truncate(itemTitle(item), slackHeaderMaxLength)),
+		},
+		{
+			Type: "section",
+			Fields: []slackText{
+				mrkdwnField("Status", item.Status),
+				mrkdwnField("Occurrences", strconv.Itoa(item.TotalOccurrences)),
+				mrkdwnField("First seen", time.Unix(int64(item.FirstOccurrenceTimestamp), 0).Format("Jan 2 15:04:05")),
+				mrkdwnField("Last seen", getTimeAgoString(lastSeenAgo)),
+				formattedField("Assigned to", unfurl.Assignee()),
+			},
+		},
+	}
+
+	context := []string{
+		"Environment: " + escapeMrkdwn(item.Environment),
+		"Level: " + escapeMrkdwn(item.Level),
+	}
+	if occurrence != nil && occurrence.Data.Server.CodeVersion != "" {
+		context = append(context, "Code version: "+escapeMrkdwn(occurrence.Data.Server.CodeVersion))
+	}
+	blocks = append(blocks, slackBlock{
+		Type:     "context",
+		Elements: []interface{}{mrkdwnText(strings.Join(context, " | "))},
+	})
+
+	if stacktrace := formatStacktrace(occurrence); stacktrace != "" {
+		blocks = append(blocks, slackBlock{
+			Type: "section",
+			Text: mrkdwnText(codeBlock(stacktrace, slackSectionMaxLength)),
+		})
+	}
+
+	if unfurl.Note != "" {
+		blocks = append(blocks, slackBlock{
+			Type:     "context",
+			Elements: []interface{}{mrkdwnText(unfurl.Note)},
+		})
+	}
+
+	// the buttons carry the URL of the link, which can't be longer than a button value
+	if unfurl.Interactive && len(unfurl.URL) <= slackButtonMaxValue {
+		blocks = append(blocks, slackBlock{
+			Type:    "actions",
+			BlockID: itemBlockID(unfurl.URL),
+			Elements: append(getItemActions(item, unfurl.URL), slackUserSelect{
+				Type:        "users_select",
+				Placeholder: plainText("Assign to..."),
+				ActionID:    itemAssignAction,
+				InitialUser: unfurl.AssigneeSlackUser,
+			}),
+		})
+	}
+
+	return slackBlockUnfurl{Blocks: blocks}
+}
+
+func getOccurrenceUnfurlBlocks(unfurl *occurrenceUnfurl) slackBlockUnfurl {
+	occurrence := unfurl.Occurrence
+	var fields []slackText
+	for _, f := range getOccurrenceFields(occurrence) {
+		fields = append(fields, formattedField(f.Title, f.Value))
+	}
+
+	blocks := []slackBlock{
+		{
+			Type: "header",
+			Text: plainText(truncate(itemTitle(unfurl.Item), slackHeaderMaxLength)),
+		},
+		{
+			Type:   "section",
+			Fields: fields,
+		},
+		{
+			Type: "context",
+			Elements: []interface{}{mrkdwnText(fmt.Sprintf("Occurrence of item #%d | Environment: %s | Level: %s",
+				unfurl.Item.Counter, escapeMrkdwn(occurrence.Data.Environment), escapeMrkdwn(occurrence.Data.Level)))},
+		},
+	}
+
+	if stacktrace := formatStacktrace(occurrence); stacktrace != "" {
+		blocks = append(blocks, slackBlock{
+			Type: "section",
+			Text: mrkdwnText(codeBlock(stacktrace, slackSectionMaxLength)),
+		})
+	}
+
+	return slackBlockUnfurl{Blocks: blocks}
+}
+
+func getSummaryUnfurlBlocks(unfurl *summaryUnfurl) slackBlockUnfurl {
+	blocks := []slackBlock{{
+		Type: "header",
+		Text: plainText(truncate(unfurl.Title, slackHeaderMaxLength)),
+	}}
+	if unfurl.Text != "" {
+		blocks = append(blocks, slackBlock{
+			Type: "section",
+			Text: mrkdwnText(truncate(unfurl.Text, slackSectionMaxLength)),
+		})
+	}
+	// a section can't have more than 10 fields
+	for i := 0; i < len(unfurl.Fields); i += slackSectionMaxFields {
+		end := i + slackSectionMaxFields
+		if end > len(unfurl.Fields) {
+			end = len(unfurl.Fields)
+		}
+		var fields []slackText
+		for _, f := range unfurl.Fields[i:end] {
+			fields = append(fields, formattedField(f.Title, f.Value))
+		}
+		blocks = append(blocks, slackBlock{Type: "section", Fields: fields})
+	}
+	if unfurl.Context != "" {
+		blocks = append(blocks, slackBlock{
+			Type:     "context",
+			Elements: []interface{}{mrkdwnText(unfurl.Context)},
+		})
+	}
+	return slackBlockUnfurl{Blocks: blocks}
+}
+
+// itemBlockID identifies the actions block of an item link. Block IDs can't be longer than
+// 255 characters, so it's a hash of the URL rather than the URL itself.
+func itemBlockID(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return "item_" + hex.EncodeToString(sum[:8])
+}
+
+// getItemActions returns the buttons that make sense for the item's current status. Their value is
+// the URL of the link, the status to set is in the action ID.
+func getItemActions(item *rollbar.Item, url string) []interface{} {
+	if item.Status == rollbar.StatusActive {
+		return []interface{}{
+			button("Resolve", itemStatusActionPrefix+rollbar.StatusResolved, url, "primary"),
+			button("Mute", itemStatusActionPrefix+rollbar.StatusMuted, url, ""),
+		}
+	}
+	return []interface{}{
+		button("Reopen", itemStatusActionPrefix+rollbar.StatusActive, url, ""),
+	}
+}
+
+// codeBlock wraps text in a mrkdwn code block no longer than max characters in total
+func codeBlock(text string, max int) string {
+	return "```" + truncate(text, max-6) + "```"
+}
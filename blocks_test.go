@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"./rollbar"
+)
+
+func TestItemHeaderWithoutTitle(t *testing.T) {
+	item := &rollbar.Item{Counter: 7, Status: rollbar.StatusActive}
+	for _, blocks := range []slackBlockUnfurl{
+		getUnfurlBlocks(&itemUnfurl{Item: item}),
+		getOccurrenceUnfurlBlocks(&occurrenceUnfurl{Item: item, Occurrence: &rollbar.Occurrence{}}),
+	} {
+		if header := blocks.Blocks[0]; header.Type != "header" || header.Text.Text != "#7" {
+			t.Errorf("header = %+v, want #7", header.Text)
+		}
+	}
+}
+
+// renderedText returns the JSON of an unfurl as Slack gets it
+func renderedText(t *testing.T, unfurl interface{}) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(unfurl); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestOccurrenceUnfurlEscapesRollbarData(t *testing.T) {
+	var occurrence rollbar.Occurrence
+	err := json.Unmarshal([]byte(`{"timestamp":1,"data":{
+		"environment":"<!here>","level":"error",
+		"server":{"host":"<!channel>","code_version":"<https://evil.example|v1>"},
+		"request":{"method":"GET","url":"https://example.com/?q=<!channel>"},
+		"person":{"username":"<!channel>","email":"<mailto:a@evil.example|admin>"},
+		"body":{"trace_chain":[{"frames":[{"filename":"<!channel>","method":"run","lineno":1}]}]}}}`), &occurrence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unfurl := &occurrenceUnfurl{Item: &rollbar.Item{Title: "<!channel> it broke"}, Occurrence: &occurrence}
+
+	//the header is plain text, everything else is mrkdwn
+	attachment := getOccurrenceUnfurlData(unfurl)
+	attachment.Fallback = ""
+	for format, mrkdwn := range map[string]interface{}{
+		unfurlFormatBlocks:      getOccurrenceUnfurlBlocks(unfurl).Blocks[1:],
+		unfurlFormatAttachments: attachment,
+	} {
+		text := renderedText(t, mrkdwn)
+		if strings.Contains(text, "<!") || strings.Contains(text, "<https:") || strings.Contains(text, "<mailto:") {
+			t.Errorf("%s unfurl isn't escaped: %s", format, text)
+		}
+		if !strings.Contains(text, "&lt;!channel&gt;") {
+			t.Errorf("%s unfurl doesn't show the host: %s", format, text)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU is a fixed-size cache that evicts the least recently used entries first.
+// Entries can optionally expire after a TTL. It is safe for concurrent use.
+type LRU struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  *list.List
+	index    map[string]*list.Element
+
+	hits   int64
+	misses int64
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// Stats is a snapshot of the cache counters
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Size   int   `json:"size"`
+}
+
+// New creates a cache holding at most capacity entries. A zero ttl means entries never expire.
+func New(capacity int, ttl time.Duration) *LRU {
+	return &LRU{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored under key, if there is one and it hasn't expired
+func (c *LRU) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.index[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.remove(el)
+		c.misses++
+		return nil, false
+	}
+	c.entries.MoveToFront(el)
+	c.hits++
+	return e.value, true
+}
+
+// Add stores value under key, evicting the least recently used entry if the cache is full
+func (c *LRU) Add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+	if el, ok := c.index[key]; ok {
+		el.Value = &entry{key: key, value: value, expires: expires}
+		c.entries.MoveToFront(el)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&entry{key: key, value: value, expires: expires})
+	if c.entries.Len() > c.capacity {
+		c.remove(c.entries.Back())
+	}
+}
+
+// Remove drops key from the cache, e.g. because the cached value is known to be stale
+func (c *LRU) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.index[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Stats returns the number of hits and misses since the cache was created
+func (c *LRU) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Size:   c.entries.Len(),
+	}
+}
+
+func (c *LRU) remove(el *list.Element) {
+	c.entries.Remove(el)
+	delete(c.index, el.Value.(*entry).key)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"./db"
+)
+
+const commandsUsage = `Usage: unfurler [command]
+
+Without a command, the app is started. Commands:
+  teams list [-json]                    list the installed teams
+  projects list [-json] <team>          list the Rollbar projects configured by a team
+  projects remove <team> <project>      remove the tokens of a project
+  tokens verify [-json] [team...]       check that the stored Rollbar tokens still work for their projects
+  reencrypt                             encrypt every stored token with UNFURLER_ENCRYPTION_KEY, after
+                                        rotating the key
+  restore <backup>                      replace the database with a backup, after checking that it is intact
+  migrate [-dry-run]                    migrate the database to the current schema, which the app also does
+                                        on startup. With -dry-run, the migrations are tried and rolled back.
+
+The app has to be stopped while a command runs, except for the listing commands (teams list, projects list,
+tokens verify) if UNFURLER_ADMIN_URL is set to the address of the running app. They are then served by its
+admin endpoints, called with UNFURLER_ADMIN_TOKEN.
+`
+
+// runCommand runs one of the maintenance commands and exits
+func runCommand(args []string) {
+	switch args[0] {
+	case "teams":
+		teamsCommand(args[1:])
+	case "projects":
+		projectsCommand(args[1:])
+	case "tokens":
+		tokensCommand(args[1:])
+	case "reencrypt":
+		reencryptCommand()
+	case "restore":
+		restoreCommand(args[1:])
+	case "migrate":
+		migrateCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(commandsUsage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n%s", args[0], commandsUsage)
+		os.Exit(2)
+	}
+}
+
+// dbPath returns the path of the database, commands don't need the rest of the configuration
+func dbPath() string {
+	if path := os.Getenv("UNFURLER_DB_PATH"); path != "" {
+		return path
+	}
+	return defaultDBPath
+}
+
+// openStore opens the database for a command. The app has to be stopped, as the database
+// can only be opened by one process at a time. Commands that only read the database open it
+// read-only, which doesn't migrate it.
+func openStore(options db.Options) db.Store {
+	loadEncryptionKeys()
+	path := dbPath()
+	store, err := db.Open(path, options)
+	if err != nil {
+		log.Fatalf("Could not open the database %s: %s", path, err.Error())
+	}
+	return store
+}
+
+func reencryptCommand() {
+	store := openStore(db.Options{})
+	if !db.EncryptionEnabled() {
+		store.Close()
+		log.Fatal("UNFURLER_ENCRYPTION_KEY is not set")
+	}
+	defer store.Close()
+	count, err := store.ReencryptTokens(true)
+	if err != nil {
+		log.Fatalf("Could not re-encrypt tokens: %s", err.Error())
+	}
+	fmt.Printf("Re-encrypted %d tokens\n", count)
+}
+
+func migrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "try the migrations and roll them back")
+	flags.Parse(args)
+
+	store := openStore(db.Options{DryRunMigrations: *dryRun})
+	store.Close()
+	if !*dryRun {
+		fmt.Printf("The database is at schema version %d\n", db.SchemaVersion())
+	}
+}
+
+func restoreCommand(args []string) {
+	if len(args) != 1 {
+		usageError()
+	}
+	path := dbPath()
+	info, err := db.Restore(path, args[0])
+	if err != nil {
+		log.Fatalf("Could not restore %s: %s", args[0], err.Error())
+	}
+	fmt.Printf("Restored %s to %s: schema version %d, %d teams\n", args[0], path, info.SchemaVersion, info.Teams)
+	if info.SchemaVersion < db.SchemaVersion() {
+		fmt.Println("The database will be migrated to the current schema when the app starts")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	dashboardHours    = 24
+	dashboardMaxItems = 10
+	// longest item title shown in the list
+	dashboardMaxTitle = 100
+)
+
+func (s *server) getDashboardUnfurl(ctx context.Context, link *rollbarLink, team string) (*summaryUnfurl, error) {
+	token := s.store.GetProjectToken(team, link.Project)
+	if token == "" {
+		return nil, errProjectNotConfigured(link.Project, team)
+	}
+	items, err := s.rollbar.GetTopActiveItems(ctx, dashboardHours, token)
+	if err != nil {
+		return nil, err
+	}
+
+	unfurl := &summaryUnfurl{
+		Title:   fmt.Sprintf("%s: top active items", link.Project),
+		Context: fmt.Sprintf("Over the last %d hours", dashboardHours),
+	}
+	if len(items) == 0 {
+		unfurl.Text = "No active items, all quiet :tada:"
+		return unfurl, nil
+	}
+
+	// item links are relative to the dashboard URL, as it has the project's original case
+	projectURL := strings.TrimRight(strings.SplitN(link.URL, "?", 2)[0], "/")
+	var lines []string
+	length := 0
+	for i, active := range items {
+		item := active.Item
+		line := fmt.Sprintf("`%s` <%s/items/%d/|#%d %s> - %d occurrences", escapeMrkdwn(item.Level),
+			projectURL, item.Counter, item.Counter, escapeMrkdwn(truncate(item.Title, dashboardMaxTitle)), item.Occurrences)
+		// whole items are left out rather than cutting the text, which could cut a link in half,
+		// leaving room for the line saying how many were left out
+		more := fmt.Sprintf("(... %d more items ...)", len(items)-i)
+		limit := slackSectionMaxLength
+		if i < len(items)-1 {
+			limit -= len(more) + 1
+		}
+		if i == dashboardMaxItems || length+utf8.RuneCountInString(line) > limit {
+			lines = append(lines, more)
+			break
+		}
+		lines = append(lines, line)
+		length += utf8.RuneCountInString(line) + 1
+	}
+	unfurl.Text = strings.Join(lines, "\n")
+	return unfurl, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"./rollbar"
+)
+
+func TestDashboardUnfurlLeavesOutWholeItems(t *testing.T) {
+	s, store := newTestServer(t, nil)
+	store.SaveProjectToken("T1", "myorg/myproject", "token", "U1", 0)
+	items := make([]rollbar.ActiveItem, dashboardMaxItems)
+	for i := range items {
+		items[i].Item.Counter = i + 1
+		items[i].Item.Level = "error"
+		items[i].Item.Title = strings.Repeat("é", 2*dashboardMaxTitle)
+	}
+	rollbarAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := json.Marshal(items)
+		fmt.Fprintf(w, `{"err":0,"result":%s}`, b)
+	}))
+	defer rollbarAPI.Close()
+	s.rollbar.BaseURL = rollbarAPI.URL
+
+	//a long project URL makes the items too long to fit in a section
+	link := &rollbarLink{Kind: dashboardLink, Project: "myorg/myproject", URL: "https://rollbar.com/MyOrg/MyProject/" + strings.Repeat("x", 300)}
+	unfurl, err := s.getDashboardUnfurl(context.Background(), link, "T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length := utf8.RuneCountInString(unfurl.Text); length > slackSectionMaxLength {
+		t.Errorf("text is %d long", length)
+	}
+	lines := strings.Split(unfurl.Text, "\n")
+	if len(lines) < 2 || len(lines) > dashboardMaxItems {
+		t.Fatalf("text has %d lines, want some of the items to be left out", len(lines))
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if !strings.HasPrefix(line, "`error` <") || !strings.Contains(line, "…> - 0 occurrences") {
+			t.Errorf("item line is cut: %q", line)
+		}
+	}
+	if more := fmt.Sprintf("(... %d more items ...)", dashboardMaxItems-len(lines)+1); lines[len(lines)-1] != more {
+		t.Errorf("last line = %q, want %q", lines[len(lines)-1], more)
+	}
+}
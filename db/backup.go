@@ -0,0 +1,158 @@
+package db
+
+import "fmt"
+
+import "github.com/boltdb/bolt"
+
+import "io"
+
+import "io/ioutil"
+
+import "os"
+
+import "log"
+
+import "path/filepath"
+
+import "sort"
+
+import "time"
+
+// BackupInfo describes a backup file
+type BackupInfo struct {
+	SchemaVersion int
+	Teams         int
+}
+
+// Backup writes a consistent copy of the database to w. The app keeps running meanwhile,
+// only writes wait for the copy to finish.
+func (s *BoltStore) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// ValidateBackup checks that the file at path is an intact database this version of the app can use
+func ValidateBackup(path string) (*BackupInfo, error) {
+	backup, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("not a database file: %s", err.Error())
+	}
+	defer backup.Close()
+
+	var info BackupInfo
+	err = backup.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return fmt.Errorf("the database is corrupted: %s", err.Error())
+		}
+		info.SchemaVersion = getSchemaVersion(tx)
+		if info.SchemaVersion > SchemaVersion() {
+			return fmt.Errorf("the backup has schema version %d, newer than %d this version of the app supports", info.SchemaVersion, SchemaVersion())
+		}
+		info.Teams = len(teamBuckets(tx))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Restore replaces the database at path with the backup, after validating it. The current
+// database is kept next to it as a .pre-restore file. It fails if the app is running.
+func Restore(path, backupPath string) (*BackupInfo, error) {
+	info, err := ValidateBackup(backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	//holding the lock makes sure the app isn't using the database while it is swapped
+	current, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s, is the app still running? %s", path, err.Error())
+	}
+	defer current.Close()
+
+	preRestore := fmt.Sprintf("%s.%s.pre-restore", path, time.Now().UTC().Format("20060102T150405"))
+	err = current.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(preRestore, 0600)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not keep a copy of the current database: %s", err.Error())
+	}
+	pruneAutomaticBackups(path + ".*.pre-restore")
+
+	//copy next to the database first, so that the swap is a rename on the same filesystem
+	if err := CopyFileAtomically(backupPath, path); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// number of copies of the database that are kept next to it before it is migrated or restored
+const keptAutomaticBackups = 3
+
+// pruneAutomaticBackups removes all but the newest keptAutomaticBackups files matching pattern
+func pruneAutomaticBackups(pattern string) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil || len(paths) <= keptAutomaticBackups {
+		return
+	}
+	modified := map[string]time.Time{}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modified[path] = info.ModTime()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return modified[paths[i]].After(modified[paths[j]]) })
+	for _, path := range paths[keptAutomaticBackups:] {
+		if err := os.Remove(path); err != nil {
+			log.Printf("pruneAutomaticBackups: %s", err.Error())
+			continue
+		}
+		log.Printf("Removed old backup %s", path)
+	}
+}
+
+// CopyFileAtomically copies src to dst through a temporary file, so that dst is never left half-written
+func CopyFileAtomically(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return WriteFileAtomically(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// WriteFileAtomically writes a file with write through a temporary file in the same directory,
+// which replaces path once it is complete
+func WriteFileAtomically(path string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,259 @@
+package db
+
+import "crypto/aes"
+
+import "crypto/cipher"
+
+import "crypto/rand"
+
+import "crypto/sha256"
+
+import "encoding/base64"
+
+import "errors"
+
+import "fmt"
+
+import "strings"
+
+import "github.com/boltdb/bolt"
+
+// Tokens are encrypted with envelope encryption: every value gets its own random data key,
+// which is stored next to it, encrypted with the master key. Encrypted values look like
+//
+//	enc:v1:base64(master key ID | sealed data key | sealed token)
+//
+// Values without the prefix were stored before encryption was enabled and are read as is.
+const encryptedPrefix = "enc:v1:"
+
+const (
+	keySize = 32
+	// identifies the master key a value was encrypted with
+	keyIDSize = 8
+	// nonce + data key + GCM tag
+	sealedKeySize = 12 + keySize + 16
+)
+
+var errNoEncryptionKey = errors.New("token is encrypted, but no encryption key is configured")
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// the key new values are encrypted with, nil if encryption is disabled
+var currentKey *masterKey
+
+// every key values can be decrypted with, by ID
+var masterKeys = map[string]*masterKey{}
+
+// SetEncryptionKeys enables encryption of the tokens with the current key. Values encrypted with
+// one of the previous keys can still be read, until ReencryptTokens moves them to the current key.
+// It must be called before Init.
+func SetEncryptionKeys(current []byte, previous ...[]byte) error {
+	masterKeys = map[string]*masterKey{}
+	for _, key := range previous {
+		if _, err := addMasterKey(key); err != nil {
+			return err
+		}
+	}
+	key, err := addMasterKey(current)
+	if err != nil {
+		return err
+	}
+	currentKey = key
+	return nil
+}
+
+// EncryptionEnabled tells if tokens are encrypted when saved
+func EncryptionEnabled() bool {
+	return currentKey != nil
+}
+
+func addMasterKey(key []byte) (*masterKey, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encryption keys must be %d bytes long, got %d", keySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	k := &masterKey{id: string(sum[:keyIDSize]), aead: aead}
+	masterKeys[k.id] = k
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealWith(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openWith(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+}
+
+// encrypt returns the value to store for token. It is stored as is if encryption is disabled.
+func encrypt(token string) ([]byte, error) {
+	if currentKey == nil {
+		return []byte(token), nil
+	}
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealedToken, err := sealWith(dataAEAD, []byte(token))
+	if err != nil {
+		return nil, err
+	}
+	sealedKey, err := sealWith(currentKey.aead, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 0, keyIDSize+len(sealedKey)+len(sealedToken))
+	raw = append(raw, currentKey.id...)
+	raw = append(raw, sealedKey...)
+	raw = append(raw, sealedToken...)
+	return []byte(encryptedPrefix + base64.RawURLEncoding.EncodeToString(raw)), nil
+}
+
+// decrypt returns the token stored in value
+func decrypt(value []byte) (string, error) {
+	if !isEncrypted(value) {
+		return string(value), nil
+	}
+	if len(masterKeys) == 0 {
+		return "", errNoEncryptionKey
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(string(value), encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < keyIDSize+sealedKeySize {
+		return "", errors.New("encrypted value is too short")
+	}
+	key, ok := masterKeys[string(raw[:keyIDSize])]
+	if !ok {
+		return "", errors.New("token is encrypted with an unknown key")
+	}
+	dataKey, err := openWith(key.aead, raw[keyIDSize:keyIDSize+sealedKeySize])
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	token, err := openWith(dataAEAD, raw[keyIDSize+sealedKeySize:])
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// matchesToken tells if the stored value is token
+func matchesToken(value []byte, token string) bool {
+	if value == nil {
+		return false
+	}
+	decrypted, err := decrypt(value)
+	return err == nil && decrypted == token
+}
+
+func isEncrypted(value []byte) bool {
+	return strings.HasPrefix(string(value), encryptedPrefix)
+}
+
+// encryptedWithCurrentKey tells if value doesn't need to be encrypted again
+func encryptedWithCurrentKey(value []byte) bool {
+	if !isEncrypted(value) {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(string(value), encryptedPrefix))
+	return err == nil && len(raw) >= keyIDSize && string(raw[:keyIDSize]) == currentKey.id
+}
+
+// ReencryptTokens encrypts every stored token with the current key. Plaintext tokens are
+// always encrypted, tokens encrypted with a previous key only if all is set. It returns how
+// many tokens were encrypted.
+func (s *BoltStore) ReencryptTokens(all bool) (int, error) {
+	if currentKey == nil {
+		return 0, errors.New("no encryption key is configured")
+	}
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		reencrypt := func(bucket *bolt.Bucket, key, value []byte) error {
+			if encryptedWithCurrentKey(value) || (isEncrypted(value) && !all) {
+				return nil
+			}
+			token, err := decrypt(value)
+			if err != nil {
+				return fmt.Errorf("could not decrypt %s: %s", key, err.Error())
+			}
+			encrypted, err := encrypt(token)
+			if err != nil {
+				return err
+			}
+			count++
+			return bucket.Put(key, encrypted)
+		}
+		reencryptAll := func(bucket *bolt.Bucket) error {
+			var keys, values [][]byte
+			bucket.ForEach(func(k, v []byte) error {
+				if v != nil {
+					keys = append(keys, append([]byte(nil), k...))
+					values = append(values, append([]byte(nil), v...))
+				}
+				return nil
+			})
+			for i := range keys {
+				if err := reencrypt(bucket, keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for _, team := range teamBuckets(tx) {
+			teamBucket := tx.Bucket(team)
+			if err := reencryptAll(teamBucket.Bucket(usersBucket)); err != nil {
+				return err
+			}
+			if err := reencryptAll(teamBucket.Bucket(projectsBucket)); err != nil {
+				return err
+			}
+			if botBucket := teamBucket.Bucket(botBucket); botBucket != nil {
+				if token := botBucket.Get(botTokenKey); token != nil {
+					if err := reencrypt(botBucket, botTokenKey, append([]byte(nil), token...)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
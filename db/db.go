@@ -1,33 +1,169 @@
 package db
 
+import "encoding/binary"
+
+import "encoding/json"
+
+import "errors"
+
 import "github.com/boltdb/bolt"
 import "log"
 
+import "os"
+
 import "fmt"
 
+import "strings"
+
+import "time"
+
 var usersBucket = []byte("users")
 var projectsBucket = []byte("projects")
+var settingsBucket = []byte("settings")
+var rollbarUsersBucket = []byte("rollbarUsers")
+
+// the bot token a team got when installing the app with OAuth v2. Teams that installed
+// it before only have user tokens, kept in the users bucket until they reinstall.
+var botBucket = []byte("bot")
+var botTokenKey = []byte("token")
+var botUserKey = []byte("user")
+
+// how each token of a team fared the last time it was used, by owner
+var tokenStatusBucket = []byte("tokenStatus")
+
+// BotTokenOwner is the owner of a team's bot token. Slack user IDs never clash with it.
+const BotTokenOwner = "bot"
+
+// AuthToken is a Slack token of a team along with how it fared the last time it was used
+type AuthToken struct {
+	//a Slack user ID, or BotTokenOwner
+	Owner string
+	Token string
+	TokenStatus
+}
+
+type TokenStatus struct {
+	LastSuccess  time.Time `json:"last_success,omitempty"`
+	FailingSince time.Time `json:"failing_since,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+func (s TokenStatus) Failing() bool {
+	return !s.FailingSince.IsZero()
+}
+
+// who set each Rollbar token of a team and how it fared when it was last checked,
+// keyed like the projects bucket
+var projectStatusBucket = []byte("projectStatus")
+
+type ProjectTokenStatus struct {
+	//Slack user who set the token, unknown for tokens set before it was recorded
+	SetBy        string    `json:"set_by,omitempty"`
+	SetAt        time.Time `json:"set_at,omitempty"`
+	LastChecked  time.Time `json:"last_checked,omitempty"`
+	FailingSince time.Time `json:"failing_since,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	//ID of the Rollbar project the token belongs to, 0 if Rollbar didn't tell
+	ProjectID int `json:"project_id,omitempty"`
+}
+
+// ErrTokenReplaced is returned when saving the status of a token that has been replaced
+// since its status was read
+var ErrTokenReplaced = errors.New("the token has been replaced")
+
+func (s ProjectTokenStatus) Failing() bool {
+	return !s.FailingSince.IsZero()
+}
+
+func projectTokenKey(project string, write bool) []byte {
+	if write {
+		return writeTokenKey(project)
+	}
+	return []byte(project)
+}
+
+// successes are recorded at most this often, to keep unfurling from writing to the database every time
+const tokenSuccessResolution = time.Minute
+
+// team sub-bucket for the occurrences cached for the team. They hold personal data, so they
+// are encrypted like tokens. Values are prefixed with the time they were saved, so that old
+// ones can be pruned.
+var occurrenceCacheBucket = []byte("occurrenceCache")
+
+// top-level bucket for the IDs of processed Slack events
+var eventsBucket = []byte("events")
 
-var db *bolt.DB
+// top-level buckets for the job queue
+var jobsBucket = []byte("jobs")
+var deadJobsBucket = []byte("deadJobs")
 
-func Init() {
-	var err error
-	db, err = bolt.Open("unfurler.db", 0600, nil)
+// write tokens are stored in the projects bucket next to the read token, under the
+// project name with this suffix. Project names never contain a colon.
+const writeTokenSuffix = ":write"
+
+func writeTokenKey(project string) []byte {
+	return []byte(project + writeTokenSuffix)
+}
+
+func isWriteTokenKey(key string) bool {
+	return strings.HasSuffix(key, writeTokenSuffix)
+}
+
+// BoltStore keeps everything in a bolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+type Options struct {
+	//run the pending migrations and roll them back, leaving the database unchanged.
+	//The store should only be closed afterwards.
+	DryRunMigrations bool
+	//open an existing database without changing it. Fails if the database isn't at
+	//the current schema version, as it isn't migrated.
+	ReadOnly bool
+}
+
+// Open opens the database at path, creating it if needed, and migrates it to the current schema
+func Open(path string, options Options) (*BoltStore, error) {
+	if options.ReadOnly {
+		//bolt would create the file, and fail to initialize it
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: options.ReadOnly})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	s := &BoltStore{db: db}
+	if options.ReadOnly {
+		if err := s.checkSchemaVersion(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	if err := s.migrate(options.DryRunMigrations); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return s, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
 }
 
-func addTeamIfNotExists(teamID string) {
+func (s *BoltStore) addTeamIfNotExists(teamID string) {
 	var exists bool
-	db.View(func(tx *bolt.Tx) error {
+	s.db.View(func(tx *bolt.Tx) error {
 		exists = tx.Bucket([]byte(teamID)) != nil
 		return nil
 	})
 	if exists {
 		return
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		//create team bucket
 		teamBucket, err := tx.CreateBucket([]byte(teamID))
 		if err != nil {
@@ -45,6 +181,18 @@ func addTeamIfNotExists(teamID string) {
 		if err != nil {
 			return err
 		}
+
+		//create settings sub-bucket
+		_, err = teamBucket.CreateBucket(settingsBucket)
+		if err != nil {
+			return err
+		}
+
+		//create rollbarUsers sub-bucket
+		_, err = teamBucket.CreateBucket(rollbarUsersBucket)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 	if err != nil {
@@ -52,41 +200,157 @@ func addTeamIfNotExists(teamID string) {
 	}
 }
 
-func GetAuthToken(teamName string) string {
-	result := ""
+func (s *BoltStore) GetTeams() []string {
+	var result []string
+	s.db.View(func(tx *bolt.Tx) error {
+		for _, team := range teamBuckets(tx) {
+			result = append(result, string(team))
+		}
+		return nil
+	})
+	return result
+}
+
+// GetAuthTokens returns the tokens of a team in the order they should be tried: the bot token,
+// then the legacy user tokens. Failing tokens come last, they are only tried if no other token works.
+func (s *BoltStore) GetAuthTokens(teamName string) []AuthToken {
+	var working, failing []AuthToken
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		teamBucket := tx.Bucket([]byte(teamName))
 		if teamBucket == nil {
 			return fmt.Errorf("Team %s is not registered", teamName)
 		}
+		statusBucket := teamBucket.Bucket(tokenStatusBucket)
 
-		usersBucket := teamBucket.Bucket(usersBucket)
-		//just get the first user in the bucket
-		user, token := usersBucket.Cursor().First()
+		add := func(owner string, value []byte) {
+			token, err := decrypt(value)
+			if err != nil {
+				log.Printf("GetAuthTokens: could not decrypt the token of %s: %s", owner, err.Error())
+				return
+			}
+			t := AuthToken{Owner: owner, Token: token}
+			if statusBucket != nil {
+				if b := statusBucket.Get([]byte(owner)); b != nil {
+					json.Unmarshal(b, &t.TokenStatus)
+				}
+			}
+			if t.Failing() {
+				failing = append(failing, t)
+			} else {
+				working = append(working, t)
+			}
+		}
 
-		if user == nil {
-			return fmt.Errorf("No users registered for team %s", teamName)
+		if botBucket := teamBucket.Bucket(botBucket); botBucket != nil {
+			if token := botBucket.Get(botTokenKey); token != nil {
+				add(BotTokenOwner, token)
+			}
 		}
+		return teamBucket.Bucket(usersBucket).ForEach(func(user, token []byte) error {
+			add(string(user), token)
+			return nil
+		})
+	})
 
-		result = string(token)
+	if err != nil {
+		log.Printf("GetAuthTokens: %s", err.Error())
+	}
 
+	return append(working, failing...)
+}
+
+func (s *BoltStore) MarkAuthTokenWorking(teamName, owner string) {
+	var status TokenStatus
+	s.db.View(func(tx *bolt.Tx) error {
+		status = getTokenStatus(tx, teamName, owner)
 		return nil
 	})
+	if !status.Failing() && time.Since(status.LastSuccess) < tokenSuccessResolution {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		status := getTokenStatus(tx, teamName, owner)
+		status.LastSuccess = time.Now()
+		status.FailingSince = time.Time{}
+		status.LastError = ""
+		return saveTokenStatus(tx, teamName, owner, status)
+	})
 
 	if err != nil {
-		log.Printf("GetAuthToken: %s", err.Error())
+		log.Printf("MarkAuthTokenWorking: %s", err.Error())
 	}
+}
 
-	return result
+func (s *BoltStore) MarkAuthTokenFailing(teamName, owner, reason string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		status := getTokenStatus(tx, teamName, owner)
+		if !status.Failing() {
+			status.FailingSince = time.Now()
+		}
+		status.LastError = reason
+		return saveTokenStatus(tx, teamName, owner, status)
+	})
+
+	if err != nil {
+		log.Printf("MarkAuthTokenFailing: %s", err.Error())
+	}
 }
 
-func SaveAuthToken(teamID, user, token string) error {
-	addTeamIfNotExists(teamID)
-	err := db.Update(func(tx *bolt.Tx) error {
+func getTokenStatus(tx *bolt.Tx, teamName, owner string) TokenStatus {
+	var status TokenStatus
+	teamBucket := tx.Bucket([]byte(teamName))
+	if teamBucket == nil {
+		return status
+	}
+	if statusBucket := teamBucket.Bucket(tokenStatusBucket); statusBucket != nil {
+		if b := statusBucket.Get([]byte(owner)); b != nil {
+			json.Unmarshal(b, &status)
+		}
+	}
+	return status
+}
+
+func saveTokenStatus(tx *bolt.Tx, teamName, owner string, status TokenStatus) error {
+	teamBucket := tx.Bucket([]byte(teamName))
+	if teamBucket == nil {
+		return fmt.Errorf("Team %s is not registered", teamName)
+	}
+	statusBucket, err := teamBucket.CreateBucketIfNotExists(tokenStatusBucket)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return statusBucket.Put([]byte(owner), b)
+}
+
+// resetTokenStatus forgets how the previous token of owner fared when it gets a new one
+func resetTokenStatus(teamBucket *bolt.Bucket, owner string) error {
+	statusBucket := teamBucket.Bucket(tokenStatusBucket)
+	if statusBucket == nil {
+		return nil
+	}
+	return statusBucket.Delete([]byte(owner))
+}
+
+func (s *BoltStore) SaveAuthToken(teamID, user, token string) error {
+	s.addTeamIfNotExists(teamID)
+	value, err := encrypt(token)
+	if err != nil {
+		log.Printf("SaveAuthToken: %s", err.Error())
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
 		teamBucket := tx.Bucket([]byte(teamID))
 		usersBucket := teamBucket.Bucket(usersBucket)
-		return usersBucket.Put([]byte(user), []byte(token))
+		if err := resetTokenStatus(teamBucket, user); err != nil {
+			return err
+		}
+		return usersBucket.Put([]byte(user), value)
 	})
 	if err != nil {
 		log.Printf("SaveAuthToken: %s", err.Error())
@@ -94,11 +358,58 @@ func SaveAuthToken(teamID, user, token string) error {
 	return err
 }
 
-func SaveProjectToken(teamID, project, token string) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (s *BoltStore) SaveBotToken(teamID, botUser, token string) error {
+	s.addTeamIfNotExists(teamID)
+	value, err := encrypt(token)
+	if err != nil {
+		log.Printf("SaveBotToken: %s", err.Error())
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(teamID))
+		botBucket, err := teamBucket.CreateBucketIfNotExists(botBucket)
+		if err != nil {
+			return err
+		}
+		if err := botBucket.Put(botTokenKey, value); err != nil {
+			return err
+		}
+		if err := botBucket.Put(botUserKey, []byte(botUser)); err != nil {
+			return err
+		}
+		if err := resetTokenStatus(teamBucket, BotTokenOwner); err != nil {
+			return err
+		}
+
+		//the bot token replaces the legacy user tokens
+		if err := teamBucket.DeleteBucket(usersBucket); err != nil {
+			return err
+		}
+		_, err = teamBucket.CreateBucket(usersBucket)
+		return err
+	})
+	if err != nil {
+		log.Printf("SaveBotToken: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) SaveProjectToken(teamID, project, token, setBy string, projectID int) error {
+	value, err := encrypt(token)
+	if err != nil {
+		log.Printf("SaveProjectToken: %s", err.Error())
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
 		teamBucket := tx.Bucket([]byte(teamID))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", teamID)
+		}
 		projectsBucket := teamBucket.Bucket(projectsBucket)
-		return projectsBucket.Put([]byte(project), []byte(token))
+		if err := projectsBucket.Put([]byte(project), value); err != nil {
+			return err
+		}
+		return saveProjectTokenStatus(teamBucket, project, false, ProjectTokenStatus{SetBy: setBy, SetAt: time.Now(), ProjectID: projectID})
 	})
 	if err != nil {
 		log.Printf("SaveProjectToken: %s", err.Error())
@@ -106,9 +417,32 @@ func SaveProjectToken(teamID, project, token string) error {
 	return err
 }
 
-func GetProjects(team string) []string {
+func (s *BoltStore) SaveProjectWriteToken(teamID, project, token, setBy string, projectID int) error {
+	value, err := encrypt(token)
+	if err != nil {
+		log.Printf("SaveProjectWriteToken: %s", err.Error())
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(teamID))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", teamID)
+		}
+		projectsBucket := teamBucket.Bucket(projectsBucket)
+		if err := projectsBucket.Put(writeTokenKey(project), value); err != nil {
+			return err
+		}
+		return saveProjectTokenStatus(teamBucket, project, true, ProjectTokenStatus{SetBy: setBy, SetAt: time.Now(), ProjectID: projectID})
+	})
+	if err != nil {
+		log.Printf("SaveProjectWriteToken: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) GetProjects(team string) []string {
 	var result []string
-	err := db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		teamBucket := tx.Bucket([]byte(team))
 		if teamBucket == nil {
 			return fmt.Errorf("Team %s is not registered", team)
@@ -116,7 +450,9 @@ func GetProjects(team string) []string {
 
 		projectsBucket := teamBucket.Bucket(projectsBucket)
 		projectsBucket.ForEach(func(project, token []byte) error {
-			result = append(result, string(project))
+			if !isWriteTokenKey(string(project)) {
+				result = append(result, string(project))
+			}
 			return nil
 		})
 
@@ -128,19 +464,20 @@ func GetProjects(team string) []string {
 	return result
 }
 
-func GetProjectToken(team, project string) string {
+func (s *BoltStore) GetProjectToken(team, project string) string {
 	result := ""
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		teamBucket := tx.Bucket([]byte(team))
 		if teamBucket == nil {
 			return fmt.Errorf("Team %s is not registered", team)
 		}
 
 		projectsBucket := teamBucket.Bucket(projectsBucket)
-		result = string(projectsBucket.Get([]byte(project)))
+		token, err := decrypt(projectsBucket.Get([]byte(project)))
+		result = token
 
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -150,8 +487,202 @@ func GetProjectToken(team, project string) string {
 	return result
 }
 
-func DeleteUserToken(teamName, user string) {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (s *BoltStore) GetProjectTokenStatus(team, project string, write bool) ProjectTokenStatus {
+	var status ProjectTokenStatus
+	s.db.View(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return nil
+		}
+		if statusBucket := teamBucket.Bucket(projectStatusBucket); statusBucket != nil {
+			if b := statusBucket.Get(projectTokenKey(project, write)); b != nil {
+				json.Unmarshal(b, &status)
+			}
+		}
+		return nil
+	})
+	return status
+}
+
+func (s *BoltStore) SaveProjectTokenStatus(team, project string, write bool, token string, status ProjectTokenStatus) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+		//the token may have been replaced, or set again, while it was being checked
+		key := projectTokenKey(project, write)
+		if !matchesToken(teamBucket.Bucket(projectsBucket).Get(key), token) {
+			return ErrTokenReplaced
+		}
+		var current ProjectTokenStatus
+		if statusBucket := teamBucket.Bucket(projectStatusBucket); statusBucket != nil {
+			if b := statusBucket.Get(key); b != nil {
+				json.Unmarshal(b, &current)
+			}
+		}
+		if !current.SetAt.Equal(status.SetAt) {
+			return ErrTokenReplaced
+		}
+		return saveProjectTokenStatus(teamBucket, project, write, status)
+	})
+	if err != nil && err != ErrTokenReplaced {
+		log.Printf("SaveProjectTokenStatus: %s", err.Error())
+	}
+	return err
+}
+
+func saveProjectTokenStatus(teamBucket *bolt.Bucket, project string, write bool, status ProjectTokenStatus) error {
+	statusBucket, err := teamBucket.CreateBucketIfNotExists(projectStatusBucket)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return statusBucket.Put(projectTokenKey(project, write), b)
+}
+
+func (s *BoltStore) GetTeamSetting(team, key string) string {
+	result := ""
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+
+		//teams installed before settings were introduced don't have the bucket
+		settingsBucket := teamBucket.Bucket(settingsBucket)
+		if settingsBucket != nil {
+			result = string(settingsBucket.Get([]byte(key)))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("GetTeamSetting: %s", err.Error())
+	}
+
+	return result
+}
+
+func (s *BoltStore) SaveTeamSetting(team, key, value string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+		settingsBucket, err := teamBucket.CreateBucketIfNotExists(settingsBucket)
+		if err != nil {
+			return err
+		}
+		return settingsBucket.Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		log.Printf("SaveTeamSetting: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) GetProjectWriteToken(team, project string) string {
+	result := ""
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+
+		projectsBucket := teamBucket.Bucket(projectsBucket)
+		token, err := decrypt(projectsBucket.Get(writeTokenKey(project)))
+		result = token
+
+		return err
+	})
+
+	if err != nil {
+		log.Printf("GetProjectWriteToken: %s", err.Error())
+	}
+
+	return result
+}
+
+func (s *BoltStore) SaveRollbarUser(team, slackUser, rollbarUser string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+		rollbarUsersBucket, err := teamBucket.CreateBucketIfNotExists(rollbarUsersBucket)
+		if err != nil {
+			return err
+		}
+		return rollbarUsersBucket.Put([]byte(slackUser), []byte(rollbarUser))
+	})
+	if err != nil {
+		log.Printf("SaveRollbarUser: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) GetRollbarUser(team, slackUser string) string {
+	result := ""
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+
+		rollbarUsersBucket := teamBucket.Bucket(rollbarUsersBucket)
+		if rollbarUsersBucket != nil {
+			result = string(rollbarUsersBucket.Get([]byte(slackUser)))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("GetRollbarUser: %s", err.Error())
+	}
+
+	return result
+}
+
+func (s *BoltStore) GetSlackUser(team, rollbarUser string) string {
+	result := ""
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+
+		rollbarUsersBucket := teamBucket.Bucket(rollbarUsersBucket)
+		if rollbarUsersBucket == nil {
+			return nil
+		}
+		//the mapping is small, a reverse index is not worth the trouble
+		return rollbarUsersBucket.ForEach(func(slackUser, rollbarUserID []byte) error {
+			if string(rollbarUserID) == rollbarUser {
+				result = string(slackUser)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		log.Printf("GetSlackUser: %s", err.Error())
+	}
+
+	return result
+}
+
+func (s *BoltStore) DeleteUserToken(teamName, user string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		teamBucket := tx.Bucket([]byte(teamName))
 		if teamBucket == nil {
 			return fmt.Errorf("Team %s is not registered", teamName)
@@ -165,14 +696,81 @@ func DeleteUserToken(teamName, user string) {
 	}
 }
 
-func DeleteProjectToken(teamName, project string) {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (s *BoltStore) DeleteBotToken(teamName string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(teamName))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", teamName)
+		}
+		if teamBucket.Bucket(botBucket) == nil {
+			return nil
+		}
+		return teamBucket.DeleteBucket(botBucket)
+	})
+
+	if err != nil {
+		log.Printf("DeleteBotToken: %s", err.Error())
+	}
+}
+
+func (s *BoltStore) DeleteAuthToken(teamName, token string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(teamName))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", teamName)
+		}
+		if bot := teamBucket.Bucket(botBucket); bot != nil && matchesToken(bot.Get(botTokenKey), token) {
+			if err := teamBucket.DeleteBucket(botBucket); err != nil {
+				return err
+			}
+		}
+
+		usersBucket := teamBucket.Bucket(usersBucket)
+		var users [][]byte
+		err := usersBucket.ForEach(func(user, value []byte) error {
+			if matchesToken(value, token) {
+				users = append(users, user)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := usersBucket.Delete(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("DeleteAuthToken: %s", err.Error())
+	}
+}
+
+func (s *BoltStore) DeleteProjectToken(teamName, project string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		teamBucket := tx.Bucket([]byte(teamName))
 		if teamBucket == nil {
 			return fmt.Errorf("Team %s is not registered", teamName)
 		}
 		projectsBucket := teamBucket.Bucket(projectsBucket)
-		return projectsBucket.Delete([]byte(project))
+		err := projectsBucket.Delete([]byte(project))
+		if err != nil {
+			return err
+		}
+		err = projectsBucket.Delete(writeTokenKey(project))
+		if err != nil {
+			return err
+		}
+		if statusBucket := teamBucket.Bucket(projectStatusBucket); statusBucket != nil {
+			if err := statusBucket.Delete([]byte(project)); err != nil {
+				return err
+			}
+			return statusBucket.Delete(writeTokenKey(project))
+		}
+		return nil
 	})
 
 	if err != nil {
@@ -180,8 +778,8 @@ func DeleteProjectToken(teamName, project string) {
 	}
 }
 
-func DeleteTeam(teamName string) {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (s *BoltStore) DeleteTeam(teamName string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		return tx.DeleteBucket([]byte(teamName))
 	})
 
@@ -189,3 +787,239 @@ func DeleteTeam(teamName string) {
 		log.Printf("DeleteTeam: %s", err.Error())
 	}
 }
+
+func (s *BoltStore) GetCachedOccurrence(team, key string) []byte {
+	var result []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return nil
+		}
+		cacheBucket := teamBucket.Bucket(occurrenceCacheBucket)
+		if cacheBucket == nil {
+			return nil
+		}
+		if value := cacheBucket.Get([]byte(key)); len(value) > 8 {
+			occurrence, err := decrypt(value[8:])
+			if err != nil {
+				//e.g. encrypted with a key that has been retired, fetch it again
+				log.Printf("GetCachedOccurrence: %s", err.Error())
+				return nil
+			}
+			result = []byte(occurrence)
+		}
+		return nil
+	})
+	return result
+}
+
+func (s *BoltStore) SaveCachedOccurrence(team, key string, value []byte) error {
+	sealed, err := encrypt(string(value))
+	if err != nil {
+		log.Printf("SaveCachedOccurrence: %s", err.Error())
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		teamBucket := tx.Bucket([]byte(team))
+		if teamBucket == nil {
+			return fmt.Errorf("Team %s is not registered", team)
+		}
+		cacheBucket, err := teamBucket.CreateBucketIfNotExists(occurrenceCacheBucket)
+		if err != nil {
+			return err
+		}
+		entry := make([]byte, 8, 8+len(sealed))
+		binary.BigEndian.PutUint64(entry, uint64(time.Now().UnixNano()))
+		return cacheBucket.Put([]byte(key), append(entry, sealed...))
+	})
+	if err != nil {
+		log.Printf("SaveCachedOccurrence: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) DeleteCachedOccurrencesBefore(cutoff time.Time) int {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, team := range teamBuckets(tx) {
+			cacheBucket := tx.Bucket(team).Bucket(occurrenceCacheBucket)
+			if cacheBucket == nil {
+				continue
+			}
+			var expired [][]byte
+			cacheBucket.ForEach(func(key, value []byte) error {
+				if len(value) < 8 || int64(binary.BigEndian.Uint64(value)) < cutoff.UnixNano() {
+					expired = append(expired, append([]byte{}, key...))
+				}
+				return nil
+			})
+			//can't delete while iterating with ForEach
+			for _, key := range expired {
+				if err := cacheBucket.Delete(key); err != nil {
+					return err
+				}
+			}
+			removed += len(expired)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("DeleteCachedOccurrencesBefore: %s", err.Error())
+	}
+	return removed
+}
+
+func jobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func (s *BoltStore) NextJobID() (uint64, error) {
+	var id uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		jobsBucket, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		id, err = jobsBucket.NextSequence()
+		return err
+	})
+	if err != nil {
+		log.Printf("NextJobID: %s", err.Error())
+	}
+	return id, err
+}
+
+func (s *BoltStore) SaveJob(id uint64, job []byte) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		jobsBucket, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		return jobsBucket.Put(jobKey(id), job)
+	})
+	if err != nil {
+		log.Printf("SaveJob: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) DeleteJob(id uint64) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		jobsBucket := tx.Bucket(jobsBucket)
+		if jobsBucket == nil {
+			return nil
+		}
+		return jobsBucket.Delete(jobKey(id))
+	})
+	if err != nil {
+		log.Printf("DeleteJob: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) GetJobs() ([][]byte, error) {
+	var result [][]byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		jobsBucket := tx.Bucket(jobsBucket)
+		if jobsBucket == nil {
+			return nil
+		}
+		return jobsBucket.ForEach(func(id, job []byte) error {
+			result = append(result, append([]byte{}, job...))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("GetJobs: %s", err.Error())
+	}
+	return result, err
+}
+
+func (s *BoltStore) SaveDeadJob(id uint64, job []byte) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		deadJobsBucket, err := tx.CreateBucketIfNotExists(deadJobsBucket)
+		if err != nil {
+			return err
+		}
+		return deadJobsBucket.Put(jobKey(id), job)
+	})
+	if err != nil {
+		log.Printf("SaveDeadJob: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) GetEventSeenAt(eventID string) time.Time {
+	var result time.Time
+	s.db.View(func(tx *bolt.Tx) error {
+		eventsBucket := tx.Bucket(eventsBucket)
+		if eventsBucket == nil {
+			return nil
+		}
+		if value := eventsBucket.Get([]byte(eventID)); len(value) == 8 {
+			result = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+		}
+		return nil
+	})
+	return result
+}
+
+func (s *BoltStore) SaveEventSeenAt(eventID string, seenAt time.Time) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		eventsBucket, err := tx.CreateBucketIfNotExists(eventsBucket)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(seenAt.UnixNano()))
+		return eventsBucket.Put([]byte(eventID), value)
+	})
+	if err != nil {
+		log.Printf("SaveEventSeenAt: %s", err.Error())
+	}
+	return err
+}
+
+func (s *BoltStore) DeleteEventSeenAt(eventID string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		eventsBucket := tx.Bucket(eventsBucket)
+		if eventsBucket == nil {
+			return nil
+		}
+		return eventsBucket.Delete([]byte(eventID))
+	})
+	if err != nil {
+		log.Printf("DeleteEventSeenAt: %s", err.Error())
+	}
+}
+
+func (s *BoltStore) DeleteEventsSeenBefore(cutoff time.Time) int {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		eventsBucket := tx.Bucket(eventsBucket)
+		if eventsBucket == nil {
+			return nil
+		}
+		var expired [][]byte
+		eventsBucket.ForEach(func(eventID, value []byte) error {
+			if len(value) != 8 || int64(binary.BigEndian.Uint64(value)) < cutoff.UnixNano() {
+				expired = append(expired, append([]byte{}, eventID...))
+			}
+			return nil
+		})
+		//can't delete while iterating with ForEach
+		for _, eventID := range expired {
+			if err := eventsBucket.Delete(eventID); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	if err != nil {
+		log.Printf("DeleteEventsSeenBefore: %s", err.Error())
+	}
+	return removed
+}
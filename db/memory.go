@@ -0,0 +1,477 @@
+package db
+
+import "errors"
+
+import "fmt"
+
+import "io"
+
+import "sort"
+
+import "sync"
+
+import "time"
+
+// MemoryStore keeps everything in memory. It is meant for tests.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	teams     map[string]*memoryTeam
+	jobs      map[uint64][]byte
+	deadJobs  map[uint64][]byte
+	lastJobID uint64
+	events    map[string]time.Time
+}
+
+type memoryTeam struct {
+	users       map[string]string
+	botToken    string
+	botUser     string
+	tokenStatus map[string]TokenStatus
+	projects    map[string]string
+	// keyed like projects
+	projectStatus map[string]ProjectTokenStatus
+	settings      map[string]string
+	rollbarUsers  map[string]string
+	occurrences   map[string]memoryOccurrence
+}
+
+type memoryOccurrence struct {
+	value   []byte
+	savedAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		teams:    map[string]*memoryTeam{},
+		jobs:     map[uint64][]byte{},
+		deadJobs: map[uint64][]byte{},
+		events:   map[string]time.Time{},
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) team(teamName string) *memoryTeam {
+	return s.teams[teamName]
+}
+
+func (s *MemoryStore) addTeamIfNotExists(teamID string) *memoryTeam {
+	team, ok := s.teams[teamID]
+	if !ok {
+		team = &memoryTeam{
+			users:         map[string]string{},
+			tokenStatus:   map[string]TokenStatus{},
+			projects:      map[string]string{},
+			projectStatus: map[string]ProjectTokenStatus{},
+			settings:      map[string]string{},
+			rollbarUsers:  map[string]string{},
+			occurrences:   map[string]memoryOccurrence{},
+		}
+		s.teams[teamID] = team
+	}
+	return team
+}
+
+func notRegistered(teamName string) error {
+	return fmt.Errorf("Team %s is not registered", teamName)
+}
+
+func (s *MemoryStore) GetTeams() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]string, 0, len(s.teams))
+	for team := range s.teams {
+		result = append(result, team)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *MemoryStore) GetAuthTokens(teamName string) []AuthToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return nil
+	}
+
+	var working, failing []AuthToken
+	add := func(owner, token string) {
+		t := AuthToken{Owner: owner, Token: token, TokenStatus: team.tokenStatus[owner]}
+		if t.Failing() {
+			failing = append(failing, t)
+		} else {
+			working = append(working, t)
+		}
+	}
+	if team.botToken != "" {
+		add(BotTokenOwner, team.botToken)
+	}
+	//same order as in bolt
+	users := make([]string, 0, len(team.users))
+	for user := range team.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		add(user, team.users[user])
+	}
+	return append(working, failing...)
+}
+
+func (s *MemoryStore) SaveAuthToken(teamID, user, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.addTeamIfNotExists(teamID)
+	team.users[user] = token
+	delete(team.tokenStatus, user)
+	return nil
+}
+
+func (s *MemoryStore) SaveBotToken(teamID, botUser, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.addTeamIfNotExists(teamID)
+	team.botToken = token
+	team.botUser = botUser
+	delete(team.tokenStatus, BotTokenOwner)
+	team.users = map[string]string{}
+	return nil
+}
+
+func (s *MemoryStore) MarkAuthTokenWorking(teamName, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		team.tokenStatus[owner] = TokenStatus{LastSuccess: time.Now()}
+	}
+}
+
+func (s *MemoryStore) MarkAuthTokenFailing(teamName, owner, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return
+	}
+	status := team.tokenStatus[owner]
+	if !status.Failing() {
+		status.FailingSince = time.Now()
+	}
+	status.LastError = reason
+	team.tokenStatus[owner] = status
+}
+
+func (s *MemoryStore) DeleteUserToken(teamName, user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		delete(team.users, user)
+	}
+}
+
+func (s *MemoryStore) DeleteBotToken(teamName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		team.botToken = ""
+		team.botUser = ""
+	}
+}
+
+func (s *MemoryStore) DeleteAuthToken(teamName, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return
+	}
+	if team.botToken == token {
+		team.botToken = ""
+		team.botUser = ""
+	}
+	for user, userToken := range team.users {
+		if userToken == token {
+			delete(team.users, user)
+		}
+	}
+}
+
+func (s *MemoryStore) GetProjects(teamName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return nil
+	}
+	var result []string
+	for project := range team.projects {
+		if !isWriteTokenKey(project) {
+			result = append(result, project)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *MemoryStore) GetProjectToken(teamName, project string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		return team.projects[project]
+	}
+	return ""
+}
+
+func (s *MemoryStore) GetProjectWriteToken(teamName, project string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		return team.projects[string(writeTokenKey(project))]
+	}
+	return ""
+}
+
+func (s *MemoryStore) SaveProjectToken(teamID, project, token, setBy string, projectID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamID)
+	if team == nil {
+		return notRegistered(teamID)
+	}
+	team.projects[project] = token
+	team.projectStatus[project] = ProjectTokenStatus{SetBy: setBy, SetAt: time.Now(), ProjectID: projectID}
+	return nil
+}
+
+func (s *MemoryStore) SaveProjectWriteToken(teamID, project, token, setBy string, projectID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamID)
+	if team == nil {
+		return notRegistered(teamID)
+	}
+	team.projects[string(writeTokenKey(project))] = token
+	team.projectStatus[string(writeTokenKey(project))] = ProjectTokenStatus{SetBy: setBy, SetAt: time.Now(), ProjectID: projectID}
+	return nil
+}
+
+func (s *MemoryStore) DeleteProjectToken(teamName, project string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		delete(team.projects, project)
+		delete(team.projects, string(writeTokenKey(project)))
+		delete(team.projectStatus, project)
+		delete(team.projectStatus, string(writeTokenKey(project)))
+	}
+}
+
+func (s *MemoryStore) GetProjectTokenStatus(teamName, project string, write bool) ProjectTokenStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		return team.projectStatus[string(projectTokenKey(project, write))]
+	}
+	return ProjectTokenStatus{}
+}
+
+func (s *MemoryStore) SaveProjectTokenStatus(teamName, project string, write bool, token string, status ProjectTokenStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return notRegistered(teamName)
+	}
+	key := string(projectTokenKey(project, write))
+	if team.projects[key] != token || !team.projectStatus[key].SetAt.Equal(status.SetAt) {
+		return ErrTokenReplaced
+	}
+	team.projectStatus[key] = status
+	return nil
+}
+
+func (s *MemoryStore) GetTeamSetting(teamName, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		return team.settings[key]
+	}
+	return ""
+}
+
+func (s *MemoryStore) SaveTeamSetting(teamName, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return notRegistered(teamName)
+	}
+	team.settings[key] = value
+	return nil
+}
+
+func (s *MemoryStore) SaveRollbarUser(teamName, slackUser, rollbarUser string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return notRegistered(teamName)
+	}
+	team.rollbarUsers[slackUser] = rollbarUser
+	return nil
+}
+
+func (s *MemoryStore) GetRollbarUser(teamName, slackUser string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		return team.rollbarUsers[slackUser]
+	}
+	return ""
+}
+
+func (s *MemoryStore) GetSlackUser(teamName, rollbarUser string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return ""
+	}
+	for slackUser, rollbarUserID := range team.rollbarUsers {
+		if rollbarUserID == rollbarUser {
+			return slackUser
+		}
+	}
+	return ""
+}
+
+func (s *MemoryStore) DeleteTeam(teamName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.teams, teamName)
+}
+
+func (s *MemoryStore) GetCachedOccurrence(teamName, key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if team := s.team(teamName); team != nil {
+		if occurrence, ok := team.occurrences[key]; ok {
+			return append([]byte{}, occurrence.value...)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveCachedOccurrence(teamName, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := s.team(teamName)
+	if team == nil {
+		return notRegistered(teamName)
+	}
+	team.occurrences[key] = memoryOccurrence{value: append([]byte{}, value...), savedAt: time.Now()}
+	return nil
+}
+
+func (s *MemoryStore) DeleteCachedOccurrencesBefore(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for _, team := range s.teams {
+		for key, occurrence := range team.occurrences {
+			if occurrence.savedAt.Before(cutoff) {
+				delete(team.occurrences, key)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+func (s *MemoryStore) NextJobID() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastJobID++
+	return s.lastJobID, nil
+}
+
+func (s *MemoryStore) SaveJob(id uint64, job []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id] = append([]byte{}, job...)
+	return nil
+}
+
+func (s *MemoryStore) DeleteJob(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
+
+func (s *MemoryStore) GetJobs() ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]uint64, 0, len(s.jobs))
+	for id := range s.jobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var result [][]byte
+	for _, id := range ids {
+		result = append(result, append([]byte{}, s.jobs[id]...))
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) SaveDeadJob(id uint64, job []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadJobs[id] = append([]byte{}, job...)
+	return nil
+}
+
+func (s *MemoryStore) GetEventSeenAt(eventID string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events[eventID]
+}
+
+func (s *MemoryStore) SaveEventSeenAt(eventID string, seenAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[eventID] = seenAt
+	return nil
+}
+
+func (s *MemoryStore) DeleteEventSeenAt(eventID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.events, eventID)
+}
+
+func (s *MemoryStore) DeleteEventsSeenBefore(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for eventID, seenAt := range s.events {
+		if seenAt.Before(cutoff) {
+			delete(s.events, eventID)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *MemoryStore) Backup(w io.Writer) (int64, error) {
+	return 0, errors.New("the in-memory store can't be backed up")
+}
+
+// ReencryptTokens does nothing, tokens kept in memory are never written to disk
+func (s *MemoryStore) ReencryptTokens(all bool) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,161 @@
+package db
+
+import "encoding/binary"
+
+import "errors"
+
+import "fmt"
+
+import "github.com/boltdb/bolt"
+
+import "log"
+
+import "time"
+
+// top-level bucket for data about the database itself
+var metaBucket = []byte("meta")
+var schemaVersionKey = []byte("schemaVersion")
+
+// errDryRun rolls back the migrations of a dry run
+var errDryRun = errors.New("dry run")
+
+type migration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations[i] upgrades the schema from version i to i+1. Only ever append to it,
+// databases out there are at every version that has been released.
+var migrations = []migration{
+	{"add the settings and rollbarUsers buckets to teams that were installed before they existed", addTeamSubBuckets},
+	{"drop the occurrence cache shared by all teams, occurrences are cached per team now", dropSharedOccurrenceCache},
+}
+
+// SchemaVersion is the version of the schema this code works with
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func getSchemaVersion(tx *bolt.Tx) int {
+	metaBucket := tx.Bucket(metaBucket)
+	if metaBucket == nil {
+		return 0
+	}
+	value := metaBucket.Get(schemaVersionKey)
+	if len(value) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(value))
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	metaBucket, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(version))
+	return metaBucket.Put(schemaVersionKey, value)
+}
+
+// checkSchemaVersion fails if the database isn't at the schema version this code works with
+func (s *BoltStore) checkSchemaVersion() error {
+	var version int
+	s.db.View(func(tx *bolt.Tx) error {
+		version = getSchemaVersion(tx)
+		return nil
+	})
+	if version != SchemaVersion() {
+		return fmt.Errorf("the database has schema version %d, not %d this version of the app works with. "+
+			"Start the app or run the migrate command to migrate it", version, SchemaVersion())
+	}
+	return nil
+}
+
+// migrate brings the schema up to date. The database is copied to a backup file next to it
+// first. In a dry run, the migrations are run and rolled back.
+func (s *BoltStore) migrate(dryRun bool) error {
+	var version int
+	var empty bool
+	s.db.View(func(tx *bolt.Tx) error {
+		version = getSchemaVersion(tx)
+		name, _ := tx.Cursor().First()
+		empty = name == nil
+		return nil
+	})
+
+	switch {
+	case version > SchemaVersion():
+		return fmt.Errorf("the database has schema version %d, newer than %d this version of the app supports", version, SchemaVersion())
+	case version == SchemaVersion():
+		return nil
+	case empty && !dryRun:
+		//a new database doesn't need migrating
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return setSchemaVersion(tx, SchemaVersion())
+		})
+	}
+
+	if !dryRun {
+		backup := fmt.Sprintf("%s.v%d-%s.bak", s.db.Path(), version, time.Now().UTC().Format("20060102T150405"))
+		err := s.db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		})
+		if err != nil {
+			return fmt.Errorf("could not back up the database before migrating: %s", err.Error())
+		}
+		log.Printf("Backed up the database to %s", backup)
+		pruneAutomaticBackups(s.db.Path() + ".v*.bak")
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for v := version; v < SchemaVersion(); v++ {
+			m := migrations[v]
+			log.Printf("Migrating the database to schema version %d: %s", v+1, m.description)
+			if err := m.migrate(tx); err != nil {
+				return fmt.Errorf("migration to schema version %d failed: %s", v+1, err.Error())
+			}
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return setSchemaVersion(tx, SchemaVersion())
+	})
+	if err == errDryRun {
+		log.Printf("Dry run: migrating from schema version %d to %d would succeed, nothing was changed", version, SchemaVersion())
+		return nil
+	}
+	return err
+}
+
+// teamBuckets returns the names of the team buckets. Other top-level buckets
+// (caches, queue, meta) have no users sub-bucket.
+func teamBuckets(tx *bolt.Tx) [][]byte {
+	var teams [][]byte
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if b.Bucket(usersBucket) != nil {
+			teams = append(teams, append([]byte(nil), name...))
+		}
+		return nil
+	})
+	return teams
+}
+
+func addTeamSubBuckets(tx *bolt.Tx) error {
+	for _, team := range teamBuckets(tx) {
+		teamBucket := tx.Bucket(team)
+		for _, name := range [][]byte{projectsBucket, settingsBucket, rollbarUsersBucket} {
+			if _, err := teamBucket.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dropSharedOccurrenceCache(tx *bolt.Tx) error {
+	if tx.Bucket(occurrenceCacheBucket) == nil {
+		return nil
+	}
+	return tx.DeleteBucket(occurrenceCacheBucket)
+}
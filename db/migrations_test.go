@@ -0,0 +1,78 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func setTestSchemaVersion(t *testing.T, path string, version int) {
+	s, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, version)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnlyOpenDoesNotMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unfurler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	if _, err := Open(path, Options{ReadOnly: true}); err == nil {
+		t.Error("read-only Open() of a missing database succeeded")
+	}
+	setTestSchemaVersion(t, path, 0)
+	if _, err := Open(path, Options{ReadOnly: true}); err == nil {
+		t.Error("read-only Open() of a database at an old schema version succeeded")
+	}
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != 0 {
+		t.Errorf("read-only Open() backed up the database: %v", backups)
+	}
+
+	s, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s, err = Open(path, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("read-only Open() of a migrated database: %s", err.Error())
+	}
+	s.Close()
+}
+
+func TestMigrationBackupsArePruned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unfurler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	for i := 0; i < keptAutomaticBackups+2; i++ {
+		//the backup files are named after the time, make every name different
+		ioutil.WriteFile(filepath.Join(dir, "test.db.v0-old"+string(rune('a'+i))+".bak"), nil, 0600)
+	}
+	setTestSchemaVersion(t, path, 0)
+	s, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != keptAutomaticBackups {
+		t.Errorf("%d backups left after migrating, want %d", len(backups), keptAutomaticBackups)
+	}
+}
@@ -0,0 +1,68 @@
+package db
+
+import "io"
+
+import "time"
+
+// Store keeps the data of the app: the tokens and settings of each team, and the state
+// of caches and the job queue that should survive a restart
+type Store interface {
+	Close() error
+
+	GetTeams() []string
+
+	GetAuthTokens(teamName string) []AuthToken
+	SaveAuthToken(teamID, user, token string) error
+	SaveBotToken(teamID, botUser, token string) error
+	MarkAuthTokenWorking(teamName, owner string)
+	MarkAuthTokenFailing(teamName, owner, reason string)
+	DeleteUserToken(teamName, user string)
+	DeleteBotToken(teamName string)
+	DeleteAuthToken(teamName, token string)
+
+	GetProjects(team string) []string
+	GetProjectToken(team, project string) string
+	GetProjectWriteToken(team, project string) string
+	// setBy is the Slack user who set the token, projectID the Rollbar project it belongs to (0 if unknown)
+	SaveProjectToken(teamID, project, token, setBy string, projectID int) error
+	SaveProjectWriteToken(teamID, project, token, setBy string, projectID int) error
+	DeleteProjectToken(teamName, project string)
+	GetProjectTokenStatus(team, project string, write bool) ProjectTokenStatus
+	// SaveProjectTokenStatus saves the status of token, read with GetProjectTokenStatus. It returns
+	// ErrTokenReplaced if the token has been set again since.
+	SaveProjectTokenStatus(team, project string, write bool, token string, status ProjectTokenStatus) error
+
+	GetTeamSetting(team, key string) string
+	SaveTeamSetting(team, key, value string) error
+
+	SaveRollbarUser(team, slackUser, rollbarUser string) error
+	GetRollbarUser(team, slackUser string) string
+	GetSlackUser(team, rollbarUser string) string
+
+	DeleteTeam(teamName string)
+
+	// occurrences are cached per team, and go away with the team
+	GetCachedOccurrence(team, key string) []byte
+	SaveCachedOccurrence(team, key string, value []byte) error
+	DeleteCachedOccurrencesBefore(cutoff time.Time) int
+
+	NextJobID() (uint64, error)
+	SaveJob(id uint64, job []byte) error
+	DeleteJob(id uint64) error
+	GetJobs() ([][]byte, error)
+	SaveDeadJob(id uint64, job []byte) error
+
+	GetEventSeenAt(eventID string) time.Time
+	SaveEventSeenAt(eventID string, seenAt time.Time) error
+	DeleteEventSeenAt(eventID string)
+	DeleteEventsSeenBefore(cutoff time.Time) int
+
+	// Backup writes a copy of the database that can be restored with Restore
+	Backup(w io.Writer) (int64, error)
+
+	// ReencryptTokens encrypts the stored tokens with the current encryption key, see SetEncryptionKeys
+	ReencryptTokens(all bool) (int, error)
+}
+
+var _ Store = (*BoltStore)(nil)
+var _ Store = (*MemoryStore)(nil)
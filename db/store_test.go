@@ -0,0 +1,353 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storeConformance runs the same checks against every Store implementation, so that tests
+// written against the MemoryStore hold for the BoltStore the app runs on
+func storeConformance(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"teams", testTeams},
+		{"auth tokens", testAuthTokens},
+		{"bot token replaces user tokens", testBotToken},
+		{"failing tokens come last", testFailingTokens},
+		{"delete auth token", testDeleteAuthToken},
+		{"projects", testProjects},
+		{"project token status", testProjectTokenStatus},
+		{"unregistered team", testUnregisteredTeam},
+		{"settings and users", testSettingsAndUsers},
+		{"delete team", testDeleteTeam},
+		{"cached occurrences", testCachedOccurrences},
+		{"jobs", testJobs},
+		{"events", testEvents},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			defer s.Close()
+			tt.test(t, s)
+		})
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	storeConformance(t, func(t *testing.T) Store {
+		dir, err := ioutil.TempDir("", "unfurler-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		s, err := Open(filepath.Join(dir, "test.db"), Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	storeConformance(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func owners(tokens []AuthToken) []string {
+	var result []string
+	for _, token := range tokens {
+		result = append(result, token.Owner)
+	}
+	return result
+}
+
+func testTeams(t *testing.T, s Store) {
+	if teams := s.GetTeams(); len(teams) != 0 {
+		t.Errorf("GetTeams() of an empty store = %v", teams)
+	}
+	s.SaveAuthToken("T2", "U1", "xoxp-1")
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	if teams := s.GetTeams(); !reflect.DeepEqual(teams, []string{"T1", "T2"}) {
+		t.Errorf("GetTeams() = %v, want [T1 T2]", teams)
+	}
+}
+
+func testAuthTokens(t *testing.T, s Store) {
+	s.SaveAuthToken("T1", "U2", "xoxp-2")
+	s.SaveAuthToken("T1", "U1", "xoxp-1")
+	tokens := s.GetAuthTokens("T1")
+	if got := owners(tokens); !reflect.DeepEqual(got, []string{"U1", "U2"}) {
+		t.Fatalf("owners = %v, want [U1 U2]", got)
+	}
+	if tokens[0].Token != "xoxp-1" {
+		t.Errorf("token of U1 = %q", tokens[0].Token)
+	}
+	s.DeleteUserToken("T1", "U1")
+	if got := owners(s.GetAuthTokens("T1")); !reflect.DeepEqual(got, []string{"U2"}) {
+		t.Errorf("owners after DeleteUserToken = %v, want [U2]", got)
+	}
+}
+
+func testBotToken(t *testing.T, s Store) {
+	s.SaveAuthToken("T1", "U1", "xoxp-1")
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	tokens := s.GetAuthTokens("T1")
+	if len(tokens) != 1 || tokens[0].Owner != BotTokenOwner || tokens[0].Token != "xoxb-1" {
+		t.Fatalf("GetAuthTokens() = %+v, want only the bot token", tokens)
+	}
+	s.DeleteBotToken("T1")
+	if tokens := s.GetAuthTokens("T1"); len(tokens) != 0 {
+		t.Errorf("GetAuthTokens() after DeleteBotToken = %+v", tokens)
+	}
+}
+
+func testFailingTokens(t *testing.T, s Store) {
+	s.SaveAuthToken("T1", "U1", "xoxp-1")
+	s.SaveAuthToken("T1", "U2", "xoxp-2")
+	s.MarkAuthTokenFailing("T1", "U1", "invalid_auth")
+	tokens := s.GetAuthTokens("T1")
+	if got := owners(tokens); !reflect.DeepEqual(got, []string{"U2", "U1"}) {
+		t.Fatalf("owners = %v, want [U2 U1]", got)
+	}
+	if !tokens[1].Failing() || tokens[1].LastError != "invalid_auth" {
+		t.Errorf("status of U1 = %+v", tokens[1].TokenStatus)
+	}
+
+	s.MarkAuthTokenWorking("T1", "U1")
+	if got := owners(s.GetAuthTokens("T1")); !reflect.DeepEqual(got, []string{"U1", "U2"}) {
+		t.Errorf("owners after MarkAuthTokenWorking = %v, want [U1 U2]", got)
+	}
+
+	//a new token starts with a clean slate
+	s.MarkAuthTokenFailing("T1", "U2", "token_revoked")
+	s.SaveAuthToken("T1", "U2", "xoxp-3")
+	for _, token := range s.GetAuthTokens("T1") {
+		if token.Failing() {
+			t.Errorf("%s is failing after getting a new token", token.Owner)
+		}
+	}
+}
+
+func testDeleteAuthToken(t *testing.T, s Store) {
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	s.SaveAuthToken("T1", "U1", "xoxp-1")
+	s.DeleteAuthToken("T1", "xoxp-1")
+	if got := owners(s.GetAuthTokens("T1")); !reflect.DeepEqual(got, []string{BotTokenOwner}) {
+		t.Errorf("owners after deleting the user token = %v", got)
+	}
+	s.DeleteAuthToken("T1", "xoxb-1")
+	if tokens := s.GetAuthTokens("T1"); len(tokens) != 0 {
+		t.Errorf("GetAuthTokens() after deleting the bot token = %+v", tokens)
+	}
+}
+
+func testProjects(t *testing.T, s Store) {
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	s.SaveProjectToken("T1", "org/b", "read-b", "U1", 0)
+	s.SaveProjectToken("T1", "org/a", "read-a", "U1", 0)
+	s.SaveProjectWriteToken("T1", "org/a", "write-a", "U1", 0)
+	if projects := s.GetProjects("T1"); !reflect.DeepEqual(projects, []string{"org/a", "org/b"}) {
+		t.Errorf("GetProjects() = %v, want [org/a org/b]", projects)
+	}
+	if token := s.GetProjectToken("T1", "org/a"); token != "read-a" {
+		t.Errorf("GetProjectToken() = %q", token)
+	}
+	if token := s.GetProjectWriteToken("T1", "org/a"); token != "write-a" {
+		t.Errorf("GetProjectWriteToken() = %q", token)
+	}
+	if token := s.GetProjectWriteToken("T1", "org/b"); token != "" {
+		t.Errorf("GetProjectWriteToken() of a project without one = %q", token)
+	}
+
+	s.DeleteProjectToken("T1", "org/a")
+	if projects := s.GetProjects("T1"); !reflect.DeepEqual(projects, []string{"org/b"}) {
+		t.Errorf("GetProjects() after DeleteProjectToken = %v", projects)
+	}
+	if token := s.GetProjectWriteToken("T1", "org/a"); token != "" {
+		t.Errorf("write token left after DeleteProjectToken: %q", token)
+	}
+	if status := s.GetProjectTokenStatus("T1", "org/a", true); status != (ProjectTokenStatus{}) {
+		t.Errorf("status left after DeleteProjectToken: %+v", status)
+	}
+}
+
+func testProjectTokenStatus(t *testing.T, s Store) {
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	s.SaveProjectToken("T1", "org/a", "read-a", "U1", 42)
+	s.SaveProjectWriteToken("T1", "org/a", "write-a", "U2", 42)
+	read := s.GetProjectTokenStatus("T1", "org/a", false)
+	if read.SetBy != "U1" || read.ProjectID != 42 || read.SetAt.IsZero() {
+		t.Errorf("status of the read token = %+v", read)
+	}
+	if write := s.GetProjectTokenStatus("T1", "org/a", true); write.SetBy != "U2" {
+		t.Errorf("status of the write token = %+v", write)
+	}
+
+	read.FailingSince = time.Now()
+	read.LastError = "invalid access token"
+	if err := s.SaveProjectTokenStatus("T1", "org/a", false, "read-a", read); err != nil {
+		t.Fatalf("SaveProjectTokenStatus() = %v", err)
+	}
+	if status := s.GetProjectTokenStatus("T1", "org/a", false); !status.Failing() || status.LastError != read.LastError {
+		t.Errorf("status after SaveProjectTokenStatus = %+v", status)
+	}
+
+	//a new token starts with a clean slate
+	s.SaveProjectToken("T1", "org/a", "read-b", "U3", 43)
+	if status := s.GetProjectTokenStatus("T1", "org/a", false); status.Failing() || status.SetBy != "U3" || status.ProjectID != 43 {
+		t.Errorf("status after setting a new token = %+v", status)
+	}
+
+	//the status of a token that was replaced while it was checked isn't saved
+	if err := s.SaveProjectTokenStatus("T1", "org/a", false, "read-a", read); err != ErrTokenReplaced {
+		t.Errorf("SaveProjectTokenStatus() of a replaced token = %v", err)
+	}
+	//neither is it if the same token was set again
+	s.SaveProjectToken("T1", "org/a", "read-b", "U4", 43)
+	if err := s.SaveProjectTokenStatus("T1", "org/a", false, "read-b", read); err != ErrTokenReplaced {
+		t.Errorf("SaveProjectTokenStatus() of a token that was set again = %v", err)
+	}
+	if status := s.GetProjectTokenStatus("T1", "org/a", false); status.Failing() || status.SetBy != "U4" {
+		t.Errorf("status after saving the status of a replaced token = %+v", status)
+	}
+}
+
+func testUnregisteredTeam(t *testing.T, s Store) {
+	if err := s.SaveProjectToken("T1", "org/a", "read-a", "U1", 0); err == nil {
+		t.Error("SaveProjectToken() of an unregistered team succeeded")
+	}
+	if err := s.SaveProjectWriteToken("T1", "org/a", "write-a", "U1", 0); err == nil {
+		t.Error("SaveProjectWriteToken() of an unregistered team succeeded")
+	}
+	if err := s.SaveTeamSetting("T1", "format", "blocks"); err == nil {
+		t.Error("SaveTeamSetting() of an unregistered team succeeded")
+	}
+	if err := s.SaveRollbarUser("T1", "U1", "1"); err == nil {
+		t.Error("SaveRollbarUser() of an unregistered team succeeded")
+	}
+	if projects := s.GetProjects("T1"); len(projects) != 0 {
+		t.Errorf("GetProjects() of an unregistered team = %v", projects)
+	}
+	if token := s.GetProjectToken("T1", "org/a"); token != "" {
+		t.Errorf("GetProjectToken() of an unregistered team = %q", token)
+	}
+	if tokens := s.GetAuthTokens("T1"); len(tokens) != 0 {
+		t.Errorf("GetAuthTokens() of an unregistered team = %+v", tokens)
+	}
+}
+
+func testSettingsAndUsers(t *testing.T, s Store) {
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	if value := s.GetTeamSetting("T1", "format"); value != "" {
+		t.Errorf("GetTeamSetting() of a setting that was never set = %q", value)
+	}
+	s.SaveTeamSetting("T1", "format", "attachments")
+	if value := s.GetTeamSetting("T1", "format"); value != "attachments" {
+		t.Errorf("GetTeamSetting() = %q", value)
+	}
+
+	s.SaveRollbarUser("T1", "U1", "7")
+	if user := s.GetRollbarUser("T1", "U1"); user != "7" {
+		t.Errorf("GetRollbarUser() = %q", user)
+	}
+	if user := s.GetSlackUser("T1", "7"); user != "U1" {
+		t.Errorf("GetSlackUser() = %q", user)
+	}
+	if user := s.GetSlackUser("T1", "8"); user != "" {
+		t.Errorf("GetSlackUser() of an unknown user = %q", user)
+	}
+}
+
+func testDeleteTeam(t *testing.T, s Store) {
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	s.SaveBotToken("T2", "B2", "xoxb-2")
+	s.SaveProjectToken("T1", "org/a", "read-a", "U1", 0)
+	s.SaveCachedOccurrence("T1", "org/a/1", []byte(`{"id":1}`))
+	s.DeleteTeam("T1")
+	if teams := s.GetTeams(); !reflect.DeepEqual(teams, []string{"T2"}) {
+		t.Errorf("GetTeams() after DeleteTeam = %v", teams)
+	}
+	if token := s.GetProjectToken("T1", "org/a"); token != "" {
+		t.Errorf("project token left after DeleteTeam: %q", token)
+	}
+	if value := s.GetCachedOccurrence("T1", "org/a/1"); value != nil {
+		t.Errorf("cached occurrence left after DeleteTeam: %s", value)
+	}
+}
+
+func testCachedOccurrences(t *testing.T, s Store) {
+	s.SaveBotToken("T1", "B1", "xoxb-1")
+	s.SaveBotToken("T2", "B2", "xoxb-2")
+	if value := s.GetCachedOccurrence("T1", "org/a/1"); value != nil {
+		t.Errorf("GetCachedOccurrence() of an occurrence that was never cached = %s", value)
+	}
+	s.SaveCachedOccurrence("T1", "org/a/1", []byte(`{"id":1}`))
+	if value := s.GetCachedOccurrence("T1", "org/a/1"); string(value) != `{"id":1}` {
+		t.Errorf("GetCachedOccurrence() = %s", value)
+	}
+	if value := s.GetCachedOccurrence("T2", "org/a/1"); value != nil {
+		t.Errorf("occurrence cached for T1 is visible to T2: %s", value)
+	}
+
+	if removed := s.DeleteCachedOccurrencesBefore(time.Now().Add(-time.Hour)); removed != 0 {
+		t.Errorf("DeleteCachedOccurrencesBefore() removed %d fresh occurrences", removed)
+	}
+	if removed := s.DeleteCachedOccurrencesBefore(time.Now().Add(time.Second)); removed != 1 {
+		t.Errorf("DeleteCachedOccurrencesBefore() removed %d occurrences, want 1", removed)
+	}
+	if value := s.GetCachedOccurrence("T1", "org/a/1"); value != nil {
+		t.Errorf("occurrence left after pruning: %s", value)
+	}
+}
+
+func testJobs(t *testing.T, s Store) {
+	first, err := s.NextJobID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := s.NextJobID()
+	if second <= first {
+		t.Errorf("NextJobID() = %d after %d", second, first)
+	}
+	s.SaveJob(second, []byte("b"))
+	s.SaveJob(first, []byte("a"))
+	jobs, err := s.GetJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || string(jobs[0]) != "a" || string(jobs[1]) != "b" {
+		t.Errorf("GetJobs() = %q, want [a b]", jobs)
+	}
+	s.DeleteJob(first)
+	s.SaveDeadJob(second, []byte("b"))
+	s.DeleteJob(second)
+	if jobs, _ := s.GetJobs(); len(jobs) != 0 {
+		t.Errorf("GetJobs() after deleting them = %q", jobs)
+	}
+}
+
+func testEvents(t *testing.T, s Store) {
+	if seenAt := s.GetEventSeenAt("Ev1"); !seenAt.IsZero() {
+		t.Errorf("GetEventSeenAt() of a new event = %v", seenAt)
+	}
+	now := time.Now()
+	s.SaveEventSeenAt("Ev1", now.Add(-2*time.Hour))
+	s.SaveEventSeenAt("Ev2", now)
+	if seenAt := s.GetEventSeenAt("Ev2"); !seenAt.Equal(now) {
+		t.Errorf("GetEventSeenAt() = %v, want %v", seenAt, now)
+	}
+	if removed := s.DeleteEventsSeenBefore(now.Add(-time.Hour)); removed != 1 {
+		t.Errorf("DeleteEventsSeenBefore() removed %d events, want 1", removed)
+	}
+	s.DeleteEventSeenAt("Ev2")
+	if seenAt := s.GetEventSeenAt("Ev2"); !seenAt.IsZero() {
+		t.Errorf("GetEventSeenAt() after DeleteEventSeenAt = %v", seenAt)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"./cache"
+	"./db"
+)
+
+const (
+	slackRetryNumHeader    = "X-Slack-Retry-Num"
+	slackRetryReasonHeader = "X-Slack-Retry-Reason"
+	// number of event IDs remembered in memory
+	eventDedupSize = 10000
+)
+
+// eventDeduper remembers the IDs of the events that were processed, so that Slack's
+// retries of an event we were slow to acknowledge don't get processed again
+type eventDeduper struct {
+	mu      sync.Mutex
+	seen    *cache.LRU
+	store   db.Store
+	ttl     time.Duration
+	persist bool
+}
+
+func newEventDeduper(store db.Store, ttl time.Duration, persist bool) *eventDeduper {
+	d := &eventDeduper{
+		seen:    cache.New(eventDedupSize, ttl),
+		store:   store,
+		ttl:     ttl,
+		persist: persist,
+	}
+	if persist {
+		go d.prune()
+	}
+	return d
+}
+
+// claim marks the event as being processed. It returns false if it already has been,
+// in which case the event should be dropped.
+func (d *eventDeduper) claim(eventID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.seen.Get(eventID); ok {
+		return false
+	}
+	now := time.Now()
+	if d.persist {
+		if seenAt := d.store.GetEventSeenAt(eventID); !seenAt.IsZero() && now.Sub(seenAt) < d.ttl {
+			d.seen.Add(eventID, seenAt)
+			return false
+		}
+		d.store.SaveEventSeenAt(eventID, now)
+	}
+	d.seen.Add(eventID, now)
+	return true
+}
+
+// release forgets the event, so that a retry of it gets processed
+func (d *eventDeduper) release(eventID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seen.Remove(eventID)
+	if d.persist {
+		d.store.DeleteEventSeenAt(eventID)
+	}
+}
+
+// prune removes expired event IDs from the database every once in a while
+func (d *eventDeduper) prune() {
+	for range time.Tick(d.ttl) {
+		if removed := d.store.DeleteEventsSeenBefore(time.Now().Add(-d.ttl)); removed > 0 {
+			log.Printf("Pruned %d expired event IDs", removed)
+		}
+	}
+}
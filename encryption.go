@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"./db"
+)
+
+// loadEncryptionKeys passes the keys tokens are encrypted with to the db package.
+// Keys are 32 random bytes, base64-encoded, given either directly or in a file.
+func loadEncryptionKeys() {
+	current := readKey("UNFURLER_ENCRYPTION_KEY")
+	previous := readKey("UNFURLER_PREVIOUS_ENCRYPTION_KEY")
+	if current == nil {
+		if previous != nil {
+			log.Fatal("UNFURLER_PREVIOUS_ENCRYPTION_KEY is set, but UNFURLER_ENCRYPTION_KEY is not")
+		}
+		return
+	}
+
+	var err error
+	if previous != nil {
+		err = db.SetEncryptionKeys(current, previous)
+	} else {
+		err = db.SetEncryptionKeys(current)
+	}
+	if err != nil {
+		log.Fatalf("Invalid encryption key: %s", err.Error())
+	}
+}
+
+// readKey reads the key in the variable env, or in the file named by env_FILE
+func readKey(env string) []byte {
+	encoded := os.Getenv(env)
+	if path := os.Getenv(env + "_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Could not read %s: %s", env+"_FILE", err.Error())
+		}
+		encoded = string(content)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil
+	}
+	addSecret(encoded)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Fatalf("%s is not valid base64: %s", env, err.Error())
+	}
+	return key
+}
+
+// encryptPlaintextTokens encrypts the tokens stored before encryption was enabled
+func encryptPlaintextTokens(store db.Store) {
+	if !db.EncryptionEnabled() {
+		log.Print("UNFURLER_ENCRYPTION_KEY is not set, tokens are stored unencrypted")
+		return
+	}
+	count, err := store.ReencryptTokens(false)
+	if err != nil {
+		log.Fatalf("Could not encrypt stored tokens: %s", err.Error())
+	}
+	if count > 0 {
+		log.Printf("Encrypted %d stored tokens", count)
+	}
+}
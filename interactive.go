@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"./rollbar"
+)
+
+const (
+	itemStatusActionPrefix = "item_status_"
+	itemAssignAction       = "item_assign"
+)
+
+type slackInteraction struct {
+	Type string
+	Team struct {
+		ID string
+	}
+	User struct {
+		ID       string
+		Username string
+	}
+	Channel struct {
+		ID string
+	}
+	// for unfurls, the container is the attachment the blocks were rendered in
+	Container struct {
+		Type      string
+		ChannelID string `json:"channel_id"`
+		MessageTS string `json:"message_ts"`
+	}
+	ResponseURL string `json:"response_url"`
+	// the link an unfurl was posted for
+	AppUnfurlURL string `json:"app_unfurl_url"`
+	Actions      []slackAction
+}
+
+type slackAction struct {
+	ActionID string `json:"action_id"`
+	BlockID  string `json:"block_id"`
+	Value    string
+	// users_select-specific field
+	SelectedUser string `json:"selected_user"`
+}
+
+func (s *server) interactiveHandler(w http.ResponseWriter, r *http.Request) {
+	var interaction slackInteraction
+	err := json.Unmarshal([]byte(r.FormValue("payload")), &interaction)
+	if err != nil {
+		log.Print("Invalid interaction payload received: " + err.Error())
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	team := interaction.Team.ID
+	log.Printf("Received interaction of type %s from team %s, user %s", interaction.Type, team, interaction.User.ID)
+
+	if interaction.Type != "block_actions" {
+		log.Printf("Unsupported interaction type %s", interaction.Type)
+		return
+	}
+
+	for _, action := range interaction.Actions {
+		// buttons carry the URL of the link, selects have no value
+		url := action.Value
+		if url == "" {
+			url = interaction.AppUnfurlURL
+		}
+		if action.BlockID != itemBlockID(url) {
+			log.Printf("Action %s doesn't belong to the unfurl of %s", action.ActionID, url)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(action.ActionID, itemStatusActionPrefix):
+			// Slack expects a response within 3 seconds, the unfurl is refreshed later
+			status := strings.TrimPrefix(action.ActionID, itemStatusActionPrefix)
+			go s.processItemStatusAction(&interaction, url, status)
+		case action.ActionID == itemAssignAction:
+			go s.processItemAssignAction(&interaction, url, action.SelectedUser)
+		default:
+			log.Printf("Unsupported action %s", action.ActionID)
+		}
+	}
+}
+
+var itemStatusDescriptions = map[string]string{
+	rollbar.StatusActive:   "Reopened",
+	rollbar.StatusResolved: "Resolved",
+	rollbar.StatusMuted:    "Muted",
+}
+
+func (s *server) processItemStatusAction(interaction *slackInteraction, url, status string) {
+	ctx := context.Background()
+	description, ok := itemStatusDescriptions[status]
+	if !ok {
+		log.Printf("Unsupported item status %s", status)
+		return
+	}
+	s.changeItem(ctx, interaction, url, func(item *rollbar.Item, writeToken string) (string, error) {
+		_, err := s.rollbar.UpdateItemStatus(ctx, item.ID, status, writeToken)
+		return fmt.Sprintf("%s by <@%s>", description, interaction.User.ID), err
+	})
+}
+
+func (s *server) processItemAssignAction(interaction *slackInteraction, url, slackUser string) {
+	ctx := context.Background()
+	rollbarUser, err := strconv.Atoi(s.store.GetRollbarUser(interaction.Team.ID, slackUser))
+	if err != nil {
+		respondEphemeral(interaction.ResponseURL, fmt.Sprintf(rollbarUnknownUser, slackUser))
+		return
+	}
+	s.changeItem(ctx, interaction, url, func(item *rollbar.Item, writeToken string) (string, error) {
+		_, err := s.rollbar.AssignItem(ctx, item.ID, rollbarUser, writeToken)
+		return fmt.Sprintf("Assigned to <@%s> by <@%s>", slackUser, interaction.User.ID), err
+	})
+}
+
+// changeItem looks up the item behind url, applies change to it with the project's write token
+// and refreshes the unfurl with the description of the change returned by change
+func (s *server) changeItem(ctx context.Context, interaction *slackInteraction, url string, change func(item *rollbar.Item, writeToken string) (string, error)) {
+	team := interaction.Team.ID
+	link, ok := parseRollbarLink(url)
+	if !ok || link.Kind != itemLink {
+		log.Printf("%s is not a Rollbar item link", url)
+		return
+	}
+	project, counter := link.Project, link.Counter
+	readToken := s.store.GetProjectToken(team, project)
+	writeToken := s.store.GetProjectWriteToken(team, project)
+	if readToken == "" || writeToken == "" {
+		log.Printf("Project %s isn't configured for changes by team %s", project, team)
+		respondEphemeral(interaction.ResponseURL, fmt.Sprintf(rollbarNoWriteToken, project))
+		return
+	}
+
+	item, err := s.rollbar.GetItemData(ctx, counter, readToken)
+	if err != nil {
+		log.Printf("error getting data for %s: %s", url, err.Error())
+		respondEphemeral(interaction.ResponseURL, rollbarGeneralError)
+		return
+	}
+	description, err := change(item, writeToken)
+	if err != nil {
+		log.Printf("error changing %s: %s", url, err.Error())
+		respondEphemeral(interaction.ResponseURL, rollbarGeneralError)
+		return
+	}
+	log.Printf("%s (team %s, item %s)", description, team, url)
+	s.items.Remove(s.itemCacheKey(team, project, counter))
+
+	unfurl, err := s.getItemUnfurl(ctx, link, team)
+	if err != nil {
+		log.Printf("Could not refresh unfurl of %s: %s", url, err.Error())
+		return
+	}
+	unfurl.Note = description + " " + slackDate(time.Now())
+
+	channel := interaction.Container.ChannelID
+	if channel == "" {
+		channel = interaction.Channel.ID
+	}
+	linkData := map[string]interface{}{
+		url: renderItemUnfurl(unfurl, s.getUnfurlFormat(team)),
+	}
+	if err := s.postUnfurls(ctx, team, channel, interaction.Container.MessageTS, linkData); err != nil {
+		log.Printf("Could not refresh unfurl of %s: %s", url, err.Error())
+	}
+}
+
+// slackDate formats t so that Slack shows it in the reader's timezone
+func slackDate(t time.Time) string {
+	return fmt.Sprintf("<!date^%d^{date_short_pretty} at {time}|%s>", t.Unix(), t.UTC().Format(time.RFC1123))
+}
+
+// respondEphemeral shows a message only to the user who triggered an interaction
+func respondEphemeral(responseURL, text string) {
+	if responseURL == "" {
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"response_type":    "ephemeral",
+		"replace_original": false,
+		"text":             text,
+	})
+	resp, err := http.Post(responseURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("error when posting interaction response: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+
+	"./queue"
+	"./slack"
+)
+
+const unfurlJobType = "unfurl"
+
+// unfurlJob asks for the links of a message to be unfurled
+type unfurlJob struct {
+	Team      string   `json:"team"`
+	Channel   string   `json:"channel"`
+	MessageTS string   `json:"message_ts"`
+	Links     []string `json:"links"`
+}
+
+func (s *server) startQueue() error {
+	s.queue = queue.New(s.store, config.QueueSize, config.Workers, config.MaxJobAttempts)
+	s.queue.Handle(unfurlJobType, s.handleUnfurlJob)
+	expvar.Publish("queue_depth", expvar.Func(func() interface{} { return s.queue.Depth() }))
+	return s.queue.Start()
+}
+
+func (s *server) handleUnfurlJob(ctx context.Context, job *queue.Job) error {
+	var unfurl unfurlJob
+	if err := json.Unmarshal(job.Payload, &unfurl); err != nil {
+		return queue.Permanent(err)
+	}
+	err := s.addLinkPreviews(ctx, &unfurl)
+	if err == errNoAuthToken {
+		return queue.Permanent(err)
+	}
+	if apiErr, ok := err.(*slack.Error); ok {
+		switch {
+		case apiErr.Code == slack.ErrRateLimited:
+			return queue.RetryAfter(err, apiErr.RetryAfter)
+		case slack.IsAuthError(err):
+			// none of the tokens worked, one may have been added or reactivated by the next attempt
+			return err
+		default:
+			// cannot_unfurl_url and the like won't change on a retry
+			return queue.Permanent(err)
+		}
+	}
+	return err
+}
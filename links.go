@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type rollbarLinkKind int
+
+const (
+	itemLink rollbarLinkKind = iota
+	occurrenceLink
+	deployLink
+	versionLink
+	dashboardLink
+)
+
+// rollbarLink is a parsed Rollbar URL that can be unfurled
+type rollbarLink struct {
+	Kind rollbarLinkKind
+	URL  string
+	// lowercased Organization/Project
+	Project string
+	// item counter, as shown in the URL
+	Counter string
+	// only set for occurrence links
+	OccurrenceID int64
+	// only set for deploy links
+	DeployID int64
+	// only set for version links
+	Environment string
+	Version     string
+}
+
+const rollbarProjectPattern = `([a-zA-Z0-9_\-\.]+\/[a-zA-Z0-9_\-\.]+)`
+
+var rollbarItemRegex = regexp.MustCompile(rollbarProjectPattern + `\/items\/(\d+)/?`)
+var rollbarOccurrenceRegex = regexp.MustCompile(rollbarProjectPattern + `\/items\/(\d+)\/occurrences\/(\d+)/?`)
+var rollbarDeployRegex = regexp.MustCompile(rollbarProjectPattern + `\/deploys\/(\d+)/?`)
+
+// version pages are either /versions/<environment>/<version>/ or /versions/<version>/?environment=<environment>
+var rollbarVersionRegex = regexp.MustCompile(rollbarProjectPattern + `\/versions\/([^\/?#]+)(?:\/([^\/?#]+))?`)
+var rollbarDashboardRegex = regexp.MustCompile(`^https?:\/\/rollbar.com\/` + rollbarProjectPattern + `\/?(?:\?.*)?$`)
+var rollbarProjectRegex = regexp.MustCompile(`https?:\/\/rollbar.com\/` + rollbarProjectPattern + `($|\/?.*)`)
+
+// parseRollbarLink works out what kind of Rollbar page url points to.
+// More specific patterns are tried first, as an occurrence URL also contains an item URL.
+func parseRollbarLink(linkURL string) (*rollbarLink, bool) {
+	if matches := rollbarOccurrenceRegex.FindStringSubmatch(linkURL); len(matches) == 4 {
+		occurrenceID, err := strconv.ParseInt(matches[3], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return &rollbarLink{
+			Kind:         occurrenceLink,
+			URL:          linkURL,
+			Project:      strings.ToLower(matches[1]),
+			Counter:      matches[2],
+			OccurrenceID: occurrenceID,
+		}, true
+	}
+	if matches := rollbarItemRegex.FindStringSubmatch(linkURL); len(matches) == 3 {
+		return &rollbarLink{
+			Kind:    itemLink,
+			URL:     linkURL,
+			Project: strings.ToLower(matches[1]),
+			Counter: matches[2],
+		}, true
+	}
+	if matches := rollbarDeployRegex.FindStringSubmatch(linkURL); len(matches) == 3 {
+		deployID, err := strconv.ParseInt(matches[2], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return &rollbarLink{
+			Kind:     deployLink,
+			URL:      linkURL,
+			Project:  strings.ToLower(matches[1]),
+			DeployID: deployID,
+		}, true
+	}
+	if matches := rollbarVersionRegex.FindStringSubmatch(linkURL); len(matches) == 4 {
+		link := &rollbarLink{
+			Kind:        versionLink,
+			URL:         linkURL,
+			Project:     strings.ToLower(matches[1]),
+			Environment: matches[2],
+			Version:     matches[3],
+		}
+		if link.Version == "" {
+			link.Version = matches[2]
+			link.Environment = ""
+			if parsed, err := url.Parse(linkURL); err == nil {
+				link.Environment = parsed.Query().Get("environment")
+			}
+		}
+		if link.Environment == "" {
+			return nil, false
+		}
+		link.Environment, _ = url.PathUnescape(link.Environment)
+		link.Version, _ = url.PathUnescape(link.Version)
+		return link, true
+	}
+	if matches := rollbarDashboardRegex.FindStringSubmatch(linkURL); len(matches) == 2 {
+		return &rollbarLink{
+			Kind:    dashboardLink,
+			URL:     linkURL,
+			Project: strings.ToLower(matches[1]),
+		}, true
+	}
+	return nil, false
+}
@@ -1,46 +1,201 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 
+	"./cache"
 	"./db"
+	"./queue"
+	"./rollbar"
+	"./slack"
 
 	"os"
+	"os/signal"
+	"syscall"
 
 	"strconv"
+	"sync"
 
 	"io/ioutil"
+
+	"time"
 )
 
+// database file used if UNFURLER_DB_PATH isn't set
+const defaultDBPath = "unfurler.db"
+
+// how long to wait for requests and queued jobs to finish when stopping
+const shutdownTimeout = 30 * time.Second
+
 type configData struct {
 	// Host for the app to listen on. May be empty to listen on all interfaces
 	ListenHost string
 	// Port for the app to listen on. Default 8888
-	ListenPort             int
-	ClientID               string
-	ClientSecret           string
+	ListenPort int
+	// Path of the database file. Default unfurler.db
+	DBPath       string
+	ClientID     string
+	ClientSecret string
+	// Signing secret used to verify requests coming from Slack
+	SlackSigningSecret string
+	// Base URL of the Rollbar API, for regional or self-hosted Rollbar
+	RollbarURL string
+	// Timeout of a single Rollbar API call
+	RollbarTimeout time.Duration
+	// Number of occurrences cached in memory
+	OccurrenceCacheSize int
+	// Keep cached occurrences in the database, so they survive restarts, for PersistedOccurrenceTTL
+	PersistOccurrenceCache bool
+	PersistedOccurrenceTTL time.Duration
+	// Number of items cached in memory, and for how long
+	ItemCacheSize int
+	ItemCacheTTL  time.Duration
+	// How long to wait for Rollbar data before unfurling the links of a message
+	UnfurlDeadline time.Duration
+	// How long the IDs of processed events are remembered, to drop Slack's retries
+	EventDedupTTL time.Duration
+	// Remember the IDs of processed events in the database, so they survive restarts
+	PersistEventDedup bool
+	// Number of jobs that can be waiting in the queue, and how many are processed at once
+	QueueSize int
+	Workers   int
+	// How many times a failing job is attempted before giving up on it
+	MaxJobAttempts int
+	// Bearer token of the admin endpoints, which are disabled if empty
+	AdminToken string
+	// Directory the database is backed up to every BackupInterval, keeping the
+	// BackupRetention latest backups. No scheduled backups if empty
+	BackupDir       string
+	BackupInterval  time.Duration
+	BackupRetention int
+	// How often the stored Rollbar tokens are checked
+	TokenCheckInterval time.Duration
+	// Legacy verification token, only checked if LegacyTokenVerification is enabled
 	SlackVerificationToken string
+	// Accept unsigned requests carrying the verification token, to migrate existing installs
+	LegacyTokenVerification bool
 }
 
 var config configData
 
 func loadConfig() {
 	port, _ := strconv.Atoi(os.Getenv("UNFURLER_PORT"))
+	legacyToken, _ := strconv.ParseBool(os.Getenv("UNFURLER_LEGACY_TOKEN_VERIFICATION"))
+	rollbarTimeout, _ := time.ParseDuration(os.Getenv("UNFURLER_ROLLBAR_TIMEOUT"))
+	occurrenceCacheSize, _ := strconv.Atoi(os.Getenv("UNFURLER_OCCURRENCE_CACHE_SIZE"))
+	persistOccurrenceCache, _ := strconv.ParseBool(os.Getenv("UNFURLER_PERSIST_OCCURRENCE_CACHE"))
+	persistedOccurrenceTTL, _ := time.ParseDuration(os.Getenv("UNFURLER_PERSISTED_OCCURRENCE_TTL"))
+	itemCacheSize, _ := strconv.Atoi(os.Getenv("UNFURLER_ITEM_CACHE_SIZE"))
+	itemCacheTTL, _ := time.ParseDuration(os.Getenv("UNFURLER_ITEM_CACHE_TTL"))
+	unfurlDeadline, _ := time.ParseDuration(os.Getenv("UNFURLER_UNFURL_DEADLINE"))
+	eventDedupTTL, _ := time.ParseDuration(os.Getenv("UNFURLER_EVENT_DEDUP_TTL"))
+	persistEventDedup, _ := strconv.ParseBool(os.Getenv("UNFURLER_PERSIST_EVENT_DEDUP"))
+	queueSize, _ := strconv.Atoi(os.Getenv("UNFURLER_QUEUE_SIZE"))
+	workers, _ := strconv.Atoi(os.Getenv("UNFURLER_WORKERS"))
+	maxJobAttempts, _ := strconv.Atoi(os.Getenv("UNFURLER_MAX_JOB_ATTEMPTS"))
+	backupInterval, _ := time.ParseDuration(os.Getenv("UNFURLER_BACKUP_INTERVAL"))
+	backupRetention, _ := strconv.Atoi(os.Getenv("UNFURLER_BACKUP_RETENTION"))
+	tokenCheckInterval, _ := time.ParseDuration(os.Getenv("UNFURLER_TOKEN_CHECK_INTERVAL"))
 
 	config = configData{
-		ListenHost:             os.Getenv("UNFURLER_HOST"),
-		ListenPort:             port,
-		ClientID:               os.Getenv("UNFURLER_CLIENT_ID"),
-		ClientSecret:           os.Getenv("UNFURLER_CLIENT_SECRET"),
-		SlackVerificationToken: os.Getenv("UNFURLER_VERIFICATION_TOKEN"),
+		ListenHost:              os.Getenv("UNFURLER_HOST"),
+		ListenPort:              port,
+		DBPath:                  os.Getenv("UNFURLER_DB_PATH"),
+		ClientID:                os.Getenv("UNFURLER_CLIENT_ID"),
+		ClientSecret:            os.Getenv("UNFURLER_CLIENT_SECRET"),
+		SlackSigningSecret:      os.Getenv("UNFURLER_SIGNING_SECRET"),
+		RollbarURL:              os.Getenv("UNFURLER_ROLLBAR_URL"),
+		RollbarTimeout:          rollbarTimeout,
+		OccurrenceCacheSize:     occurrenceCacheSize,
+		PersistOccurrenceCache:  persistOccurrenceCache,
+		PersistedOccurrenceTTL:  persistedOccurrenceTTL,
+		ItemCacheSize:           itemCacheSize,
+		ItemCacheTTL:            itemCacheTTL,
+		UnfurlDeadline:          unfurlDeadline,
+		EventDedupTTL:           eventDedupTTL,
+		PersistEventDedup:       persistEventDedup,
+		QueueSize:               queueSize,
+		Workers:                 workers,
+		MaxJobAttempts:          maxJobAttempts,
+		AdminToken:              os.Getenv("UNFURLER_ADMIN_TOKEN"),
+		BackupDir:               os.Getenv("UNFURLER_BACKUP_DIR"),
+		BackupInterval:          backupInterval,
+		BackupRetention:         backupRetention,
+		TokenCheckInterval:      tokenCheckInterval,
+		SlackVerificationToken:  os.Getenv("UNFURLER_VERIFICATION_TOKEN"),
+		LegacyTokenVerification: legacyToken,
 	}
 
 	// set defaults and validate
 	if config.ListenPort == 0 {
 		config.ListenPort = 8888
 	}
+	if config.DBPath == "" {
+		config.DBPath = defaultDBPath
+	}
+
+	if config.RollbarURL == "" {
+		config.RollbarURL = rollbar.DefaultBaseURL
+	}
+	if config.RollbarTimeout == 0 {
+		config.RollbarTimeout = rollbar.DefaultTimeout
+	}
+
+	if config.OccurrenceCacheSize == 0 {
+		config.OccurrenceCacheSize = 1000
+	}
+	if config.PersistedOccurrenceTTL == 0 {
+		config.PersistedOccurrenceTTL = 7 * 24 * time.Hour
+	}
+	if config.PersistedOccurrenceTTL < 0 {
+		log.Fatal("UNFURLER_PERSISTED_OCCURRENCE_TTL has to be positive")
+	}
+	if config.ItemCacheSize == 0 {
+		config.ItemCacheSize = 1000
+	}
+	if config.ItemCacheTTL == 0 {
+		config.ItemCacheTTL = time.Minute
+	}
+	if config.UnfurlDeadline == 0 {
+		config.UnfurlDeadline = 5 * time.Second
+	}
+	if config.EventDedupTTL == 0 {
+		config.EventDedupTTL = time.Hour
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 1000
+	}
+	if config.Workers == 0 {
+		config.Workers = 4
+	}
+	if config.MaxJobAttempts == 0 {
+		config.MaxJobAttempts = 5
+	}
+	if config.BackupInterval == 0 {
+		config.BackupInterval = 24 * time.Hour
+	}
+	if config.BackupRetention == 0 {
+		config.BackupRetention = 7
+	}
+	if config.TokenCheckInterval == 0 {
+		config.TokenCheckInterval = 24 * time.Hour
+	}
+
+	if config.BackupInterval < 0 {
+		log.Fatal("UNFURLER_BACKUP_INTERVAL has to be positive")
+	}
+	if config.BackupRetention < 0 {
+		log.Fatal("UNFURLER_BACKUP_RETENTION has to be positive")
+	}
+
+	if config.TokenCheckInterval < 0 {
+		log.Fatal("UNFURLER_TOKEN_CHECK_INTERVAL has to be positive")
+	}
 
 	if config.ClientID == "" {
 		log.Fatal("UNFURLER_CLIENT_ID is not set")
@@ -48,11 +203,40 @@ func loadConfig() {
 	if config.ClientSecret == "" {
 		log.Fatal("UNFURLER_CLIENT_SECRET is not set")
 	}
-	if config.SlackVerificationToken == "" {
-		log.Fatal("UNFURLER_VERIFICATION_TOKEN is not set")
+	if config.SlackSigningSecret == "" && !config.LegacyTokenVerification {
+		log.Fatal("UNFURLER_SIGNING_SECRET is not set")
+	}
+	if config.LegacyTokenVerification && config.SlackVerificationToken == "" {
+		log.Fatal("UNFURLER_VERIFICATION_TOKEN is not set, but legacy token verification is enabled")
 	}
 }
 
+// server holds the dependencies of the HTTP handlers
+type server struct {
+	store       db.Store
+	rollbar     *rollbar.Client
+	slack       *slack.Client
+	items       *cache.LRU
+	occurrences *cache.LRU
+	queue       *queue.Queue
+	events      *eventDeduper
+}
+
+func newServer(store db.Store) *server {
+	rollbarClient := rollbar.NewClient()
+	rollbarClient.BaseURL = config.RollbarURL
+	rollbarClient.HTTPClient.Timeout = config.RollbarTimeout
+	s := &server{
+		store:       store,
+		rollbar:     rollbarClient,
+		slack:       slack.NewClient(),
+		items:       cache.New(config.ItemCacheSize, config.ItemCacheTTL),
+		occurrences: cache.New(config.OccurrenceCacheSize, 0),
+		events:      newEventDeduper(store, config.EventDedupTTL, config.PersistEventDedup),
+	}
+	return s
+}
+
 func serveFile(w http.ResponseWriter, path string) {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -63,15 +247,108 @@ func serveFile(w http.ResponseWriter, path string) {
 	w.Write(content)
 }
 
+// serveTemplate renders the HTML template at path with data
+func serveTemplate(w http.ResponseWriter, path string, status int, data interface{}) {
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		log.Printf("Could not parse template %s: %s", path, err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		log.Printf("Could not render template %s: %s", path, err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
+
 func main() {
+	log.SetOutput(redactingWriter{w: os.Stderr})
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
 	loadConfig()
-	db.Init()
+	addSecret(config.ClientSecret)
+	addSecret(config.SlackSigningSecret)
+	addSecret(config.SlackVerificationToken)
+	addSecret(config.AdminToken)
+	loadEncryptionKeys()
+	store, err := db.Open(config.DBPath, db.Options{})
+	if err != nil {
+		log.Fatalf("Could not open the database: %s", err.Error())
+	}
+	encryptPlaintextTokens(store)
+	s := newServer(store)
+	publishCacheStats(s)
+	if err := s.startQueue(); err != nil {
+		log.Fatalf("Could not start the job queue: %s", err.Error())
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		serveFile(w, "static/index.html")
 	})
-	http.HandleFunc("/slack", slackEventHandler)
-	http.HandleFunc("/oauth", oauthCallbackHandler)
-	http.HandleFunc("/slash", slashCommandHandler)
-	log.Printf("Unfurler listening on %s:%d...", config.ListenHost, config.ListenPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", config.ListenHost, config.ListenPort), nil))
+	http.HandleFunc("/slack", verifySlackRequest(s.slackEventHandler))
+	http.HandleFunc("/install", installHandler)
+	http.HandleFunc("/oauth", s.oauthCallbackHandler)
+	http.HandleFunc("/slash", verifySlackRequest(s.slashCommandHandler))
+	http.HandleFunc("/interactive", verifySlackRequest(s.interactiveHandler))
+	http.HandleFunc("/admin/backup", requireAdmin(s.backupHandler))
+	http.HandleFunc("/admin/teams", requireAdmin(s.teamsHandler))
+	http.HandleFunc("/admin/projects", requireAdmin(s.projectsHandler))
+	http.HandleFunc("/admin/tokens/verify", requireAdmin(s.verifyTokensHandler))
+
+	// background tasks stop when quit is closed
+	quit := make(chan struct{})
+	var background sync.WaitGroup
+	if config.BackupDir != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			s.scheduleBackups(config.BackupDir, config.BackupInterval, config.BackupRetention, quit)
+		}()
+	}
+	if config.PersistOccurrenceCache {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			s.pruneCachedOccurrences(config.PersistedOccurrenceTTL, quit)
+		}()
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		s.scheduleTokenValidation(config.TokenCheckInterval, quit)
+	}()
+
+	httpServer := &http.Server{Addr: fmt.Sprintf("%s:%d", config.ListenHost, config.ListenPort)}
+	go func() {
+		log.Printf("Unfurler listening on %s:%d...", config.ListenHost, config.ListenPort)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Print("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %s", err.Error())
+	}
+	// no new jobs can come in now, finish the ones that are queued
+	if err := s.queue.Shutdown(ctx); err != nil {
+		log.Printf("Queue shutdown: %s, unfinished jobs will be resumed on restart", err.Error())
+	}
+	close(quit)
+	background.Wait()
+	if err := store.Close(); err != nil {
+		log.Printf("Could not close the database: %s", err.Error())
+	}
 }
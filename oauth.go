@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"./slack"
+)
+
+const (
+	slackAuthorizeURL = "https://slack.com/oauth/v2/authorize"
+	// bot token scopes requested when the app is installed
+	slackBotScopes = "links:read,links:write,commands,chat:write"
+
+	oauthStateCookie = "unfurler_oauth_state"
+	// how long a user has to go through the Slack consent screen
+	oauthStateMaxAge = 10 * time.Minute
+)
+
+// installHandler sends the user to Slack to install the app. The state parameter is
+// stored in a cookie too, so the callback can tell that the user started the flow here.
+func installHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := newOauthState(time.Now())
+	if err != nil {
+		log.Printf("Could not generate OAuth state: %s", err.Error())
+		http.Error(w, "Could not start the installation", 500)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/oauth",
+		MaxAge:   int(oauthStateMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{}
+	query.Add("client_id", config.ClientID)
+	query.Add("scope", slackBotScopes)
+	query.Add("state", state)
+	http.Redirect(w, r, slackAuthorizeURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// installResult is shown on the page the user lands on after the Slack consent screen
+type installResult struct {
+	TeamName string
+	Reason   string
+}
+
+func (s *server) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err == nil {
+		err = checkOauthState(r.FormValue("state"), cookie.Value, time.Now())
+	}
+	if err != nil {
+		log.Printf("Installation failed, rejected OAuth callback: %s", err.Error())
+		serveTemplate(w, "static/install_failed.html", 403, installResult{
+			Reason: "the installation link has expired or was opened in another browser.",
+		})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/oauth", MaxAge: -1})
+
+	if slackError := r.FormValue("error"); slackError != "" {
+		log.Printf("Installation failed, Slack reported %s", slackError)
+		reason := fmt.Sprintf("Slack reported an error (%s).", slackError)
+		if slackError == "access_denied" {
+			reason = "access to the workspace was not granted."
+		}
+		serveTemplate(w, "static/install_failed.html", 200, installResult{Reason: reason})
+		return
+	}
+
+	code := r.FormValue("code")
+	if code == "" {
+		log.Print("Installation failed, no OAuth code received")
+		serveTemplate(w, "static/install_failed.html", 400, installResult{
+			Reason: "Slack did not send an authorization code.",
+		})
+		return
+	}
+
+	result, err := s.exchangeOauthCodeForToken(r.Context(), code)
+	if err != nil {
+		reason := "Slack could not be reached."
+		if code := slack.ErrorCode(err); code != "" {
+			reason = fmt.Sprintf("Slack did not accept the installation (%s).", code)
+		}
+		if result != nil {
+			reason = "the installation could not be saved."
+		}
+		serveTemplate(w, "static/install_failed.html", 500, installResult{TeamName: teamName(result), Reason: reason})
+		return
+	}
+	serveTemplate(w, "static/thanks.html", 200, installResult{TeamName: teamName(result)})
+}
+
+func teamName(result *slack.OAuthV2Response) string {
+	if result == nil {
+		return ""
+	}
+	return result.Team.Name
+}
+
+// exchangeOauthCodeForToken stores the bot token the code is exchanged for. If the
+// exchange succeeded but saving failed, the Slack response is returned with the error.
+func (s *server) exchangeOauthCodeForToken(ctx context.Context, code string) (*slack.OAuthV2Response, error) {
+	log.Print("Posting oauth.v2.access")
+
+	oauthResponse, err := s.slack.OAuthV2Access(ctx, config.ClientID, config.ClientSecret, code)
+	if err != nil {
+		log.Printf("Installation failed, could not exchange the OAuth code: %s", err.Error())
+		return nil, err
+	}
+	err = s.store.SaveBotToken(oauthResponse.Team.ID, oauthResponse.BotUserID, oauthResponse.AccessToken)
+	if err != nil {
+		log.Printf("Installation failed, could not save bot token for team %s: %s", oauthResponse.Team.ID, err.Error())
+		return oauthResponse, err
+	}
+	log.Printf("Installation succeeded, saved bot token for team %s (%s), installed by %s", oauthResponse.Team.ID, oauthResponse.Team.Name, oauthResponse.AuthedUser.ID)
+	return oauthResponse, nil
+}
+
+// newOauthState returns a random nonce and its creation time, signed with the client secret
+func newOauthState(now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := hex.EncodeToString(nonce) + "." + strconv.FormatInt(now.Unix(), 10)
+	return payload + "." + signOauthState(payload), nil
+}
+
+// checkOauthState verifies that state came back unchanged from Slack, matches the
+// one given to this browser and isn't too old
+func checkOauthState(state, expected string, now time.Time) error {
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		return fmt.Errorf("state does not match the one of this browser")
+	}
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed state %q", state)
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signOauthState(payload))) {
+		return fmt.Errorf("state signature mismatch")
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed state timestamp %q", parts[1])
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > oauthStateMaxAge || age < 0 {
+		return fmt.Errorf("state has expired")
+	}
+	return nil
+}
+
+func signOauthState(payload string) string {
+	mac := hmac.New(sha256.New, []byte(config.ClientSecret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
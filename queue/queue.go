@@ -0,0 +1,329 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Enqueue when the queue already holds as many jobs as it may
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrShuttingDown is returned by Enqueue once Shutdown has been called
+var ErrShuttingDown = errors.New("queue is shutting down")
+
+const (
+	// first retry delay, doubled on every attempt
+	retryBaseDelay = 2 * time.Second
+	retryMaxDelay  = 5 * time.Minute
+)
+
+// Job is a unit of work. Jobs are persisted until they succeed or run out of attempts,
+// so they survive restarts.
+type Job struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	NotBefore time.Time       `json:"not_before"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Handler processes a job. An error makes the job retried later, unless it's wrapped with Permanent.
+type Handler func(ctx context.Context, job *Job) error
+
+// Store persists jobs
+type Store interface {
+	NextJobID() (uint64, error)
+	SaveJob(id uint64, job []byte) error
+	DeleteJob(id uint64) error
+	GetJobs() ([][]byte, error)
+	// SaveDeadJob keeps a job that ran out of attempts, for inspection
+	SaveDeadJob(id uint64, job []byte) error
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks an error that retrying won't fix. The job is dead-lettered right away.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+// RetryAfter asks for the job to be retried no sooner than after delay, instead of the usual backoff.
+// It still counts as a failed attempt.
+func RetryAfter(err error, delay time.Duration) error {
+	return &retryAfterError{err: err, delay: delay}
+}
+
+// Queue is a bounded, persistent job queue processed by a pool of workers
+type Queue struct {
+	store       Store
+	size        int
+	workers     int
+	maxAttempts int
+	handlers    map[string]Handler
+
+	jobs chan *Job
+	// cancels the context of running handlers when a shutdown times out
+	ctx    context.Context
+	cancel context.CancelFunc
+	quit   chan struct{}
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	pending  int
+	stopping bool
+}
+
+// New creates a queue holding at most size jobs, processed by the given number of workers.
+// Failing jobs are attempted up to maxAttempts times.
+func New(store Store, size, workers, maxAttempts int) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		store:       store,
+		size:        size,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		handlers:    make(map[string]Handler),
+		jobs:        make(chan *Job, size),
+		ctx:         ctx,
+		cancel:      cancel,
+		quit:        make(chan struct{}),
+	}
+}
+
+// Handle registers the handler of a job type. It must be called before Start.
+func (q *Queue) Handle(jobType string, handler Handler) {
+	q.handlers[jobType] = handler
+}
+
+// Start resumes the jobs persisted by a previous run and starts the workers
+func (q *Queue) Start() error {
+	stored, err := q.store.GetJobs()
+	if err != nil {
+		return err
+	}
+	for _, b := range stored {
+		var job Job
+		if err := json.Unmarshal(b, &job); err != nil {
+			log.Printf("Skipping unreadable job: %s", err.Error())
+			continue
+		}
+		q.pending++
+		q.schedule(&job)
+	}
+	if len(stored) > 0 {
+		log.Printf("Resumed %d jobs", len(stored))
+	}
+
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return nil
+}
+
+// Enqueue persists a new job and schedules it for processing
+func (q *Queue) Enqueue(jobType string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	if q.stopping {
+		q.mu.Unlock()
+		return ErrShuttingDown
+	}
+	if q.pending >= q.size {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	q.pending++
+	q.mu.Unlock()
+
+	id, err := q.store.NextJobID()
+	if err != nil {
+		q.done()
+		return err
+	}
+	job := &Job{
+		ID:        id,
+		Type:      jobType,
+		Payload:   b,
+		CreatedAt: time.Now(),
+	}
+	if err := q.save(job); err != nil {
+		q.done()
+		return err
+	}
+	q.schedule(job)
+	return nil
+}
+
+// Depth returns the number of jobs waiting or being processed
+func (q *Queue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// Shutdown stops accepting jobs and waits for the workers to finish the jobs that are ready.
+// Jobs waiting for a retry are left in the store and resumed on the next Start. If ctx
+// expires first, running handlers are cancelled.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	q.stopping = true
+	q.mu.Unlock()
+	close(q.quit)
+
+	finished := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-finished
+		return ctx.Err()
+	}
+}
+
+// schedule hands the job to the workers once it is due
+func (q *Queue) schedule(job *Job) {
+	go func() {
+		if wait := time.Until(job.NotBefore); wait > 0 {
+			t := time.NewTimer(wait)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-q.quit:
+				// stays in the store until the next start
+				return
+			}
+		}
+		select {
+		case q.jobs <- job:
+		case <-q.quit:
+		}
+	}()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		// drain the jobs that are ready before stopping
+		select {
+		case job := <-q.jobs:
+			q.process(job)
+			continue
+		default:
+		}
+		select {
+		case job := <-q.jobs:
+			q.process(job)
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+func (q *Queue) process(job *Job) {
+	handler, ok := q.handlers[job.Type]
+	if !ok {
+		q.deadLetter(job, fmt.Errorf("no handler for job type %s", job.Type))
+		return
+	}
+
+	job.Attempts++
+	err := handler(q.ctx, job)
+	if err == nil {
+		if err := q.store.DeleteJob(job.ID); err != nil {
+			log.Printf("Could not delete job %d: %s", job.ID, err.Error())
+		}
+		q.done()
+		return
+	}
+
+	job.LastError = err.Error()
+	if _, permanent := err.(*permanentError); permanent || job.Attempts >= q.maxAttempts {
+		q.deadLetter(job, err)
+		return
+	}
+
+	delay := retryDelay(job.Attempts)
+	if retryAfter, ok := err.(*retryAfterError); ok && retryAfter.delay > delay {
+		delay = retryAfter.delay
+	}
+	job.NotBefore = time.Now().Add(delay)
+	log.Printf("Job %d (%s) failed, attempt %d of %d, retrying in %s: %s",
+		job.ID, job.Type, job.Attempts, q.maxAttempts, delay, err.Error())
+	if err := q.save(job); err != nil {
+		log.Printf("Could not save job %d: %s", job.ID, err.Error())
+	}
+	q.schedule(job)
+}
+
+func (q *Queue) deadLetter(job *Job, err error) {
+	log.Printf("Job %d (%s) failed after %d attempts, giving up: %s", job.ID, job.Type, job.Attempts, err.Error())
+	job.LastError = err.Error()
+	b, marshalErr := json.Marshal(job)
+	if marshalErr == nil {
+		marshalErr = q.store.SaveDeadJob(job.ID, b)
+	}
+	if marshalErr != nil {
+		log.Printf("Could not dead-letter job %d: %s", job.ID, marshalErr.Error())
+	}
+	if err := q.store.DeleteJob(job.ID); err != nil {
+		log.Printf("Could not delete job %d: %s", job.ID, err.Error())
+	}
+	q.done()
+}
+
+func (q *Queue) save(job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.store.SaveJob(job.ID, b)
+}
+
+func (q *Queue) done() {
+	q.mu.Lock()
+	q.pending--
+	q.mu.Unlock()
+}
+
+// retryDelay returns a jittered exponential backoff delay for the given attempt, counting from 1
+func retryDelay(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt-1)
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+var tokenPatterns = []*regexp.Regexp{
+	// Rollbar project access tokens
+	regexp.MustCompile(`\b[0-9a-fA-F]{32}\b`),
+	// Slack OAuth tokens
+	regexp.MustCompile(`\bxox[a-z]-[A-Za-z0-9-]+`),
+	// anything passed as a token in a URL or a form
+	regexp.MustCompile(`((?:access_)?token=)[^&\s"]+`),
+}
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// addSecret makes redact scrub a value that doesn't look like a token, e.g. the app's own credentials
+func addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// redact replaces anything that looks like an access token in s
+func redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	secretsMu.RUnlock()
+	for _, pattern := range tokenPatterns {
+		// patterns without a group have nothing to keep, ${1} is then empty
+		s = pattern.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
+
+// redactingWriter scrubs tokens from everything written through it. The log package
+// writes each log line with a single Write call, so tokens are never split between calls.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
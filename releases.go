@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func (s *server) getDeployUnfurl(ctx context.Context, link *rollbarLink, team string) (*summaryUnfurl, error) {
+	token := s.store.GetProjectToken(team, link.Project)
+	if token == "" {
+		return nil, errProjectNotConfigured(link.Project, team)
+	}
+	deploy, err := s.rollbar.GetDeployData(ctx, link.DeployID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	//the fields are mrkdwn, and the deployer and comment are whatever was sent with the deploy
+	deployer := escapeMrkdwn(deploy.LocalUsername)
+	if deployer == "" && deploy.UserID != nil {
+		deployer = fmt.Sprintf("Rollbar user #%v", deploy.UserID)
+	}
+	unfurl := &summaryUnfurl{
+		Title: fmt.Sprintf("Deploy of %s to %s", deploy.Revision, deploy.Environment),
+		Fields: []slackAttachmentField{
+			{Title: "Environment", Value: escapeMrkdwn(deploy.Environment), Short: true},
+			{Title: "Revision", Value: escapeMrkdwn(deploy.Revision), Short: true},
+			{Title: "Status", Value: escapeMrkdwn(deploy.Status), Short: true},
+		},
+		Context: link.Project,
+	}
+	if deployer != "" {
+		unfurl.Fields = append(unfurl.Fields, slackAttachmentField{Title: "Deployed by", Value: deployer, Short: true})
+	}
+	if deploy.StartTime != 0 {
+		unfurl.Fields = append(unfurl.Fields, slackAttachmentField{
+			Title: "Started",
+			Value: time.Unix(deploy.StartTime, 0).Format("Jan 2 15:04:05"),
+			Short: true,
+		})
+	}
+	if deploy.FinishTime != 0 {
+		unfurl.Fields = append(unfurl.Fields, slackAttachmentField{
+			Title: "Finished",
+			Value: time.Unix(deploy.FinishTime, 0).Format("Jan 2 15:04:05"),
+			Short: true,
+		})
+	}
+	if deploy.Comment != "" {
+		unfurl.Fields = append(unfurl.Fields, slackAttachmentField{Title: "Comment", Value: escapeMrkdwn(deploy.Comment), Short: false})
+	}
+	return unfurl, nil
+}
+
+func (s *server) getVersionUnfurl(ctx context.Context, link *rollbarLink, team string) (*summaryUnfurl, error) {
+	token := s.store.GetProjectToken(team, link.Project)
+	if token == "" {
+		return nil, errProjectNotConfigured(link.Project, team)
+	}
+	version, err := s.rollbar.GetVersionData(ctx, link.Version, link.Environment, token)
+	if err != nil {
+		return nil, err
+	}
+
+	unfurl := &summaryUnfurl{
+		Title: fmt.Sprintf("Version %s in %s", version.Version, version.Environment),
+		Fields: []slackAttachmentField{
+			{Title: "New items", Value: strconv.Itoa(version.ItemCount("new")), Short: true},
+			{Title: "Reactivated items", Value: strconv.Itoa(version.ItemCount("reactivated")), Short: true},
+			{Title: "Resolved items", Value: strconv.Itoa(version.ItemCount("resolved")), Short: true},
+		},
+		Context: link.Project,
+	}
+	if version.FirstOccurrenceTimestamp != 0 {
+		unfurl.Fields = append(unfurl.Fields, slackAttachmentField{
+			Title: "First seen",
+			Value: time.Unix(version.FirstOccurrenceTimestamp, 0).Format("Jan 2 15:04:05"),
+			Short: true,
+		})
+	}
+	return unfurl, nil
+}
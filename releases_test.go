@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeployUnfurlEscapesDeployData(t *testing.T) {
+	s, store := newTestServer(t, nil)
+	store.SaveProjectToken("T1", "myorg/myproject", "token", "U1", 0)
+	rollbarAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"err":0,"result":{"id":1,"environment":"production","revision":"abc",
+			"local_username":"<!channel>","comment":"<https://evil.example|release notes>"}}`)
+	}))
+	defer rollbarAPI.Close()
+	s.rollbar.BaseURL = rollbarAPI.URL
+
+	unfurl, err := s.getDeployUnfurl(context.Background(), &rollbarLink{Kind: deployLink, Project: "myorg/myproject", DeployID: 1}, "T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range unfurl.Fields {
+		if strings.Contains(f.Value, "<") {
+			t.Errorf("%s isn't escaped: %q", f.Title, f.Value)
+		}
+	}
+	if text := renderedText(t, unfurl.Fields); !strings.Contains(text, "&lt;!channel&gt;") || !strings.Contains(text, "release notes") {
+		t.Errorf("fields don't show the deployer and comment: %s", text)
+	}
+}
@@ -0,0 +1,182 @@
+package rollbar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the address of the public Rollbar API
+	DefaultBaseURL = "https://api.rollbar.com/api/1"
+	// DefaultTimeout limits how long a single API call may take
+	DefaultTimeout = 10 * time.Second
+	// TokenHeader carries the project access token. Tokens are never put in the URL,
+	// so they don't end up in proxy logs or in the text of url.Error
+	TokenHeader = "X-Rollbar-Access-Token"
+	// DefaultUserAgent is sent with every API call unless the client is configured otherwise
+	DefaultUserAgent = "rollbar-unfurler"
+	// DefaultMaxRetries is how many times a call failing with a 429 or 5xx status is retried
+	DefaultMaxRetries = 3
+	// DefaultMaxWait is the longest a call waits for a token's rate limit to reset
+	DefaultMaxWait = 5 * time.Second
+)
+
+// Client talks to the Rollbar API. Every call is authenticated with the project access token
+// passed to it, so a single client can be shared between all projects.
+type Client struct {
+	// BaseURL of the API, without a trailing slash, e.g. https://api.rollbar.com/api/1
+	BaseURL    string
+	HTTPClient *http.Client
+	UserAgent  string
+	MaxRetries int
+	MaxWait    time.Duration
+
+	limiter *limiter
+}
+
+// NewClient creates a client for the public Rollbar API with the default timeout
+func NewClient() *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		UserAgent:  DefaultUserAgent,
+		MaxRetries: DefaultMaxRetries,
+		MaxWait:    DefaultMaxWait,
+		limiter:    newLimiter(),
+	}
+}
+
+// apiResponse is the envelope every Rollbar API response comes in
+type apiResponse struct {
+	Err     int
+	Result  json.RawMessage
+	Message string
+}
+
+// get calls a read endpoint and decodes the result into result
+func (c *Client) get(ctx context.Context, path string, query url.Values, token string, result interface{}) error {
+	return c.do(ctx, http.MethodGet, path, query, nil, token, result)
+}
+
+// do calls the API and decodes the result of the call into result. body, if not nil, is sent as JSON.
+// Calls are delayed to stay within the token's rate limit, and retried if Rollbar is overloaded.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}, token string, result interface{}) error {
+	apiURL := strings.TrimRight(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		apiURL += "?" + query.Encode()
+	}
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(ctx, token, c.MaxWait); err != nil {
+			return err
+		}
+		err := c.doOnce(ctx, method, apiURL, reqBody, token, result)
+		retryable, ok := err.(*retryableError)
+		if !ok {
+			return err
+		}
+		if attempt >= c.MaxRetries {
+			return retryable.err
+		}
+		delay := retryDelay(attempt)
+		if retryable.err == ErrRateLimited {
+			// no point in retrying before the limit resets
+			resetIn := c.limiter.resetIn(token)
+			if resetIn > c.MaxWait {
+				return ErrRateLimited
+			}
+			if resetIn > delay {
+				delay = resetIn
+			}
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// retryableError is a failure that may go away if the call is repeated later
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (c *Client) doOnce(ctx context.Context, method, apiURL string, body []byte, token string, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, apiURL, reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	req.Header.Set(TokenHeader, token)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c.limiter.update(token, resp.Header)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &retryableError{err: ErrRateLimited}
+	case resp.StatusCode >= 500:
+		return &retryableError{err: fmt.Errorf("server error: %s", resp.Status)}
+	}
+
+	// other errors, e.g. invalid tokens, come with an error message in the body
+	var envelope apiResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&envelope)
+	failed := resp.StatusCode < 200 || resp.StatusCode > 299
+	switch {
+	case envelope.Err != 0 || (failed && envelope.Message != ""):
+		return &APIError{Message: envelope.Message}
+	case failed:
+		return &APIError{Message: resp.Status}
+	case decodeErr != nil:
+		return fmt.Errorf("could not decode response (%s): %s", resp.Status, decodeErr.Error())
+	}
+	if result == nil || len(envelope.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+// APIError is an error reported by the Rollbar API in the response body
+type APIError struct {
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error: %s", e.Message)
+}
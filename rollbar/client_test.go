@@ -0,0 +1,91 @@
+package rollbar
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestClient returns a client for an API served by handler, that doesn't retry failed calls
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c := NewClient()
+	c.BaseURL = server.URL
+	c.MaxRetries = 0
+	return c
+}
+
+func TestClientSendsTokenInHeader(t *testing.T) {
+	var got *http.Request
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		fmt.Fprint(w, `{"err":0,"result":{"id":1,"counter":7,"title":"Boom"}}`)
+	})
+
+	item, err := c.GetItemData(context.Background(), "7", "secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Title != "Boom" {
+		t.Errorf("item = %+v", item)
+	}
+	if token := got.Header.Get(TokenHeader); token != "secret-token" {
+		t.Errorf("%s = %q", TokenHeader, token)
+	}
+	if strings.Contains(got.URL.String(), "secret-token") {
+		t.Errorf("token is in the URL: %s", got.URL)
+	}
+	if got.URL.Path != "/item_by_counter/7" {
+		t.Errorf("path = %s", got.URL.Path)
+	}
+	if ua := got.Header.Get("User-Agent"); ua != DefaultUserAgent {
+		t.Errorf("User-Agent = %q, want %q", ua, DefaultUserAgent)
+	}
+
+	c.UserAgent = "custom-agent"
+	c.GetItemData(context.Background(), "7", "secret-token")
+	if ua := got.Header.Get("User-Agent"); ua != "custom-agent" {
+		t.Errorf("User-Agent = %q, want the configured one", ua)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		status  int
+		body    string
+		invalid bool
+		message string
+	}{
+		{"invalid token", http.StatusUnauthorized, `{"err":1,"message":"invalid access token"}`, true, ""},
+		{"error in body", http.StatusOK, `{"err":1,"message":"Item not found"}`, false, "Item not found"},
+		{"error status", http.StatusNotFound, `{"err":1,"message":"Not found"}`, false, "Not found"},
+		{"error status without body", http.StatusForbidden, `<html>Forbidden</html>`, false, "403 Forbidden"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+
+			_, err := c.GetProject(context.Background(), "token")
+			if tt.invalid {
+				if err != ErrInvalidToken {
+					t.Errorf("err = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			apiErr, ok := err.(*APIError)
+			if !ok {
+				t.Fatalf("err = %#v, want an APIError", err)
+			}
+			if apiErr.Message != tt.message {
+				t.Errorf("message = %q, want %q", apiErr.Message, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package rollbar
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a call can't be made because the token has used up
+// its Rollbar rate limit, and the limit doesn't reset soon enough to wait for it
+var ErrRateLimited = errors.New("rate limited by Rollbar")
+
+const (
+	rateLimitLimitHeader     = "X-Rate-Limit-Limit"
+	rateLimitRemainingHeader = "X-Rate-Limit-Remaining"
+	rateLimitResetHeader     = "X-Rate-Limit-Reset"
+
+	// calls are spread out once less than this fraction of the limit is left
+	rateLimitLowWater = 0.1
+)
+
+// first retry delay, doubled on every attempt
+var retryBaseDelay = 500 * time.Millisecond
+
+// limiter tracks the rate limit Rollbar reports for each token, and delays calls
+// so that a token doesn't run out of calls before its limit resets
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*bucket)}
+}
+
+// wait blocks until a call with token may be made. It fails with ErrRateLimited
+// instead of waiting longer than maxWait for the limit to reset.
+func (l *limiter) wait(ctx context.Context, token string, maxWait time.Duration) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	b, ok := l.buckets[token]
+	if !ok || time.Now().After(b.reset) {
+		l.mu.Unlock()
+		return nil
+	}
+	untilReset := time.Until(b.reset)
+	var delay time.Duration
+	switch {
+	case b.remaining <= 0:
+		if untilReset > maxWait {
+			l.mu.Unlock()
+			return ErrRateLimited
+		}
+		delay = untilReset
+	case float64(b.remaining) < float64(b.limit)*rateLimitLowWater:
+		// spread the remaining calls evenly until the reset
+		delay = untilReset / time.Duration(b.remaining+1)
+		if delay > maxWait {
+			delay = maxWait
+		}
+	}
+	// count the call now, so concurrent callers see it before the response comes in
+	b.remaining--
+	l.mu.Unlock()
+
+	return sleep(ctx, delay)
+}
+
+// update records the rate limit state reported in the response headers
+func (l *limiter) update(token string, header http.Header) {
+	if l == nil {
+		return
+	}
+	limit, err1 := strconv.Atoi(header.Get(rateLimitLimitHeader))
+	remaining, err2 := strconv.Atoi(header.Get(rateLimitRemainingHeader))
+	reset, err3 := strconv.ParseInt(header.Get(rateLimitResetHeader), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets[token] = &bucket{
+		limit:     limit,
+		remaining: remaining,
+		reset:     time.Unix(reset, 0),
+	}
+}
+
+// resetIn returns how long until the token's limit resets, or 0 if it isn't known
+func (l *limiter) resetIn(token string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[token]; ok && time.Now().Before(b.reset) {
+		return time.Until(b.reset)
+	}
+	return 0
+}
+
+// retryDelay returns a jittered exponential backoff delay for the given attempt, counting from 0
+func retryDelay(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
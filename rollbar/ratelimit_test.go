@@ -0,0 +1,152 @@
+package rollbar
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	retryBaseDelay = time.Millisecond
+}
+
+func rateLimitHeader(limit, remaining int, reset time.Time) http.Header {
+	h := http.Header{}
+	h.Set(rateLimitLimitHeader, strconv.Itoa(limit))
+	h.Set(rateLimitRemainingHeader, strconv.Itoa(remaining))
+	h.Set(rateLimitResetHeader, strconv.FormatInt(reset.Unix(), 10))
+	return h
+}
+
+func TestLimiterUpdate(t *testing.T) {
+	reset := time.Now().Add(time.Minute).Truncate(time.Second)
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   *bucket
+	}{
+		{"all headers", rateLimitHeader(100, 42, reset), &bucket{limit: 100, remaining: 42, reset: reset}},
+		{"no headers", http.Header{}, nil},
+		{"bad reset", http.Header{
+			rateLimitLimitHeader:     {"100"},
+			rateLimitRemainingHeader: {"42"},
+			rateLimitResetHeader:     {"soon"},
+		}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter()
+			l.update("token", tt.header)
+			got := l.buckets["token"]
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("bucket = %+v, want none", got)
+			case tt.want != nil && (got == nil || got.limit != tt.want.limit || got.remaining != tt.want.remaining || !got.reset.Equal(tt.want.reset)):
+				t.Errorf("bucket = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		remaining int
+		resetIn   time.Duration
+		maxWait   time.Duration
+		err       error
+		minDelay  time.Duration
+	}{
+		{"calls left", 50, time.Minute, time.Second, nil, 0},
+		{"used up, reset too late", 0, time.Minute, 10 * time.Millisecond, ErrRateLimited, 0},
+		{"used up, reset soon", 0, 1500 * time.Millisecond, 2 * time.Second, nil, 400 * time.Millisecond},
+		{"limit already reset", 0, -time.Second, time.Millisecond, nil, 0},
+		{"few calls left", 1, 2 * time.Second, 50 * time.Millisecond, nil, 40 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter()
+			l.buckets["token"] = &bucket{limit: 100, remaining: tt.remaining, reset: time.Now().Add(tt.resetIn)}
+			start := time.Now()
+			err := l.wait(context.Background(), "token", tt.maxWait)
+			waited := time.Since(start)
+			if err != tt.err {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if waited < tt.minDelay || waited > tt.maxWait+100*time.Millisecond {
+				t.Errorf("waited %s, want between %s and %s", waited, tt.minDelay, tt.maxWait)
+			}
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		statuses []int
+		calls    int32
+		err      bool
+	}{
+		{"succeeds", []int{http.StatusOK}, 1, false},
+		{"server error then success", []int{http.StatusBadGateway, http.StatusOK}, 2, false},
+		{"rate limited then success", []int{http.StatusTooManyRequests, http.StatusOK}, 2, false},
+		{"fails every time", []int{http.StatusServiceUnavailable}, 3, true},
+		{"client error", []int{http.StatusNotFound}, 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&calls, 1)) - 1
+				if n >= len(tt.statuses) {
+					n = len(tt.statuses) - 1
+				}
+				w.WriteHeader(tt.statuses[n])
+				if tt.statuses[n] == http.StatusOK {
+					fmt.Fprint(w, `{"err":0,"result":{"id":1}}`)
+				} else {
+					fmt.Fprint(w, `{"err":1,"message":"failed"}`)
+				}
+			})
+			c.MaxRetries = 2
+
+			_, err := c.GetItemData(context.Background(), "1", "token")
+			if (err != nil) != tt.err {
+				t.Errorf("err = %v", err)
+			}
+			if calls != tt.calls {
+				t.Errorf("%d calls, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestClientGivesUpWhenRateLimitResetsTooLate(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		for k, v := range rateLimitHeader(100, 0, time.Now().Add(time.Hour)) {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	c.MaxRetries = 3
+	c.MaxWait = 10 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetItemData(context.Background(), "1", "token"); err != ErrRateLimited {
+			t.Errorf("err = %v, want ErrRateLimited", err)
+		}
+	}
+	//the second call doesn't even try, the limit is known to be used up
+	if calls != 1 {
+		t.Errorf("%d calls, want 1", calls)
+	}
+
+	//other tokens have their own limit
+	c.GetItemData(context.Background(), "1", "other")
+	if calls != 2 {
+		t.Errorf("%d calls, want the other token to be tried", calls)
+	}
+}
@@ -1,20 +1,15 @@
 package rollbar
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"regexp"
+	"net/url"
+	"strconv"
 )
 
-type itemResponse struct {
-	Err     int
-	Result  Item
-	Message string
-}
-
-// Item blah
+// Item is the JSON representation of a Rollbar item
 type Item struct {
 	ID                       int         `json:"id"`
 	ProjectID                int         `json:"project_id"`
@@ -37,7 +32,7 @@ type Item struct {
 	Status                   string      `json:"status"`
 	Level                    string      `json:"level"`
 	IntegrationsData         interface{} `json:"integrations_data"`
-	AssignedUserID           interface{} `json:"assigned_user_id"`
+	AssignedUserID           *int        `json:"assigned_user_id"`
 	GroupItemID              interface{} `json:"group_item_id"`
 	GroupStatus              int         `json:"group_status"`
 }
@@ -70,6 +65,16 @@ type Occurrence struct {
 				} `json:"frames"`
 			} `json:"trace_chain"`
 		} `json:"body"`
+		Request struct {
+			URL    string `json:"url"`
+			Method string `json:"method"`
+		} `json:"request"`
+		Person struct {
+			// may be either a string or a number, depending on the SDK
+			ID       interface{} `json:"id"`
+			Username string      `json:"username"`
+			Email    string      `json:"email"`
+		} `json:"person"`
 		Platform    string `json:"platform"`
 		Environment string `json:"environment"`
 		Framework   string `json:"framework"`
@@ -78,72 +83,152 @@ type Occurrence struct {
 	} `json:"data"`
 }
 
-type occurrenceResponse struct {
-	Err     int
-	Result  Occurrence
-	Message string
+// Deploy is the JSON representation of a Rollbar deploy
+type Deploy struct {
+	ID            int64       `json:"id"`
+	ProjectID     int         `json:"project_id"`
+	Environment   string      `json:"environment"`
+	Revision      string      `json:"revision"`
+	LocalUsername string      `json:"local_username"`
+	UserID        interface{} `json:"user_id"`
+	Comment       string      `json:"comment"`
+	Status        string      `json:"status"`
+	StartTime     int64       `json:"start_time"`
+	FinishTime    int64       `json:"finish_time"`
 }
 
-var re = regexp.MustCompile(`(\w+\/\w+)\/items\/(\d+)/?`)
+// Version is the JSON representation of a Rollbar version summary
+type Version struct {
+	Version                  string `json:"version"`
+	Environment              string `json:"environment"`
+	FirstOccurrenceTimestamp int64  `json:"first_occurrence_timestamp"`
+	LastOccurrenceTimestamp  int64  `json:"last_occurrence_timestamp"`
+	// item counts by level, for each of "new", "reactivated", "repeated" and "resolved"
+	ItemStats map[string]map[string]int `json:"item_stats"`
+}
 
-// IsValidToken checks if token is a valid Rollbar read-level project token.
-// Unfortunately, there is no way to see if a token belongs to project with a certain URL --
-// we can only obtain project ID from the API if the token is valid, which is hardly helpful.
-// So, the least we can do is check that token is a valid token and hope the user has copied
-// it from the correct page.
-func IsValidToken(token string) bool {
-	if token == "" {
-		return false
-	}
-	apiURL := fmt.Sprintf("https://api.rollbar.com/api/1/item/1?access_token=%s", token)
-	resp, err := http.Get(apiURL)
-	if err != nil {
-		log.Printf("IsValidToken error: %s", err.Error())
-		return false
-	}
-	defer resp.Body.Close()
-	var result itemResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("IsValidToken error: %s", err.Error())
-		return false
+// ItemCount sums the item counts of all levels in a category of ItemStats
+func (v *Version) ItemCount(category string) int {
+	total := 0
+	for _, count := range v.ItemStats[category] {
+		total += count
 	}
+	return total
+}
 
-	return result.Err == 0 || result.Message != "invalid access token"
+// ActiveItem is an entry of the top active items report
+type ActiveItem struct {
+	Item struct {
+		ID                      int    `json:"id"`
+		Counter                 int    `json:"counter"`
+		Environment             string `json:"environment"`
+		Title                   string `json:"title"`
+		Level                   string `json:"level"`
+		LastOccurrenceTimestamp int64  `json:"last_occurrence_timestamp"`
+		// occurrences within the report period
+		Occurrences       int `json:"occurrences"`
+		UniqueOccurrences int `json:"unique_occurrences"`
+	} `json:"item"`
+	// occurrences per hour within the report period
+	Counts []int `json:"counts"`
 }
 
-// GetItemData sfes
-func GetItemData(counter, token string) (*Item, error) {
-	apiURL := fmt.Sprintf("https://api.rollbar.com/api/1/item_by_counter/%s?access_token=%s", counter, token)
-	resp, err := http.Get(apiURL)
+// Project is the JSON representation of a Rollbar project
+type Project struct {
+	ID        int    `json:"id"`
+	AccountID int    `json:"account_id"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+}
+
+// ErrInvalidToken is returned by GetProject when Rollbar doesn't accept a token
+var ErrInvalidToken = errors.New("invalid access token")
+
+// GetProject fetches the project a project access token belongs to. The name of the project is the
+// last part of its URL; the account only comes as an ID, so it can't be matched against the URL.
+func (c *Client) GetProject(ctx context.Context, token string) (*Project, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	var project Project
+	err := c.get(ctx, "/project", nil, token, &project)
+	if apiErr, ok := err.(*APIError); ok && apiErr.Message == "invalid access token" {
+		return nil, ErrInvalidToken
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	var result itemResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	return &project, nil
+}
+
+// GetItemData fetches an item by its project-specific counter, the number shown in item URLs
+func (c *Client) GetItemData(ctx context.Context, counter, token string) (*Item, error) {
+	var item Item
+	if err := c.get(ctx, "/item_by_counter/"+url.PathEscape(counter), nil, token, &item); err != nil {
 		return nil, err
 	}
-	if result.Err != 0 {
-		return nil, fmt.Errorf("API error: %s", result.Message)
+	return &item, nil
+}
+
+// GetOccurrenceData fetches an occurrence by its ID
+func (c *Client) GetOccurrenceData(ctx context.Context, id int64, token string) (*Occurrence, error) {
+	var occurrence Occurrence
+	if err := c.get(ctx, fmt.Sprintf("/instance/%d", id), nil, token, &occurrence); err != nil {
+		return nil, err
 	}
-	return &result.Result, nil
+	return &occurrence, nil
 }
 
-// GetOccurrenceData aegaa
-func GetOccurrenceData(id int64, token string) (*Occurrence, error) {
-	apiURL := fmt.Sprintf("https://api.rollbar.com/api/1/instance/%d?access_token=%s", id, token)
-	resp, err := http.Get(apiURL)
-	if err != nil {
+// GetDeployData fetches a deploy by its ID
+func (c *Client) GetDeployData(ctx context.Context, id int64, token string) (*Deploy, error) {
+	var deploy Deploy
+	if err := c.get(ctx, fmt.Sprintf("/deploy/%d", id), nil, token, &deploy); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	var result occurrenceResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	return &deploy, nil
+}
+
+// GetVersionData fetches the summary of a code version in an environment
+func (c *Client) GetVersionData(ctx context.Context, version, environment, token string) (*Version, error) {
+	var result Version
+	query := url.Values{"environment": {environment}}
+	if err := c.get(ctx, "/versions/"+url.PathEscape(version), query, token, &result); err != nil {
 		return nil, err
 	}
-	if result.Err != 0 {
-		return nil, fmt.Errorf("API error: %s", result.Message)
+	return &result, nil
+}
+
+// GetTopActiveItems lists the items with the most occurrences over the last hours, most active first
+func (c *Client) GetTopActiveItems(ctx context.Context, hours int, token string) ([]ActiveItem, error) {
+	var items []ActiveItem
+	query := url.Values{"hours": {strconv.Itoa(hours)}}
+	if err := c.get(ctx, "/reports/top_active_items", query, token, &items); err != nil {
+		return nil, err
 	}
+	return items, nil
+}
 
-	return &result.Result, nil
+// Item statuses that can be set with UpdateItemStatus
+const (
+	StatusActive   = "active"
+	StatusResolved = "resolved"
+	StatusMuted    = "muted"
+)
+
+// UpdateItemStatus changes the status of the item with the given ID. It requires a write-scoped token.
+func (c *Client) UpdateItemStatus(ctx context.Context, id int, status, token string) (*Item, error) {
+	return c.updateItem(ctx, id, map[string]interface{}{"status": status}, token)
+}
+
+// AssignItem assigns the item with the given ID to a Rollbar user. It requires a write-scoped token.
+func (c *Client) AssignItem(ctx context.Context, id, userID int, token string) (*Item, error) {
+	return c.updateItem(ctx, id, map[string]interface{}{"assigned_user_id": userID}, token)
+}
+
+func (c *Client) updateItem(ctx context.Context, id int, fields map[string]interface{}, token string) (*Item, error) {
+	var item Item
+	if err := c.do(ctx, http.MethodPatch, fmt.Sprintf("/item/%d", id), nil, fields, token, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"./rollbar"
+)
+
+// how often occurrences past their TTL are removed from the database
+const occurrencePruneInterval = time.Hour
+
+// occurrences found in the persistent cache after missing the in-memory one
+var persistedOccurrenceHits = expvar.NewInt("occurrence_cache_persisted_hits")
+
+func publishCacheStats(s *server) {
+	expvar.Publish("item_cache", expvar.Func(func() interface{} { return s.items.Stats() }))
+	expvar.Publish("occurrence_cache", expvar.Func(func() interface{} { return s.occurrences.Stats() }))
+}
+
+// cacheScope is the part of the cache keys that keeps teams from seeing data fetched for
+// other Rollbar projects. A project slug only says which token the team has stored for it,
+// not which Rollbar project the token belongs to, and anyone can create a project with the
+// same name in another account. Data is shared between the teams whose read token belongs
+// to the same Rollbar project; with a token whose project couldn't be verified, a team only
+// sees what was fetched for it.
+func (s *server) cacheScope(team, project string) string {
+	if id := s.store.GetProjectTokenStatus(team, project, false).ProjectID; id != 0 {
+		return fmt.Sprintf("project:%d", id)
+	}
+	return fmt.Sprintf("team:%s/%s", team, project)
+}
+
+func (s *server) itemCacheKey(team, project, counter string) string {
+	return fmt.Sprintf("%s/%s", s.cacheScope(team, project), counter)
+}
+
+func (s *server) occurrenceCacheKey(team, project string, id int64) string {
+	return fmt.Sprintf("%s/%d", s.cacheScope(team, project), id)
+}
+
+// getItem returns the item from the cache, or fetches it if it's not cached or the cached copy is too old.
+// Items change as new occurrences come in, so they are only cached for a short while.
+func (s *server) getItem(ctx context.Context, team, project, counter, token string) (*rollbar.Item, error) {
+	key := s.itemCacheKey(team, project, counter)
+	if item, ok := s.items.Get(key); ok {
+		return item.(*rollbar.Item), nil
+	}
+	item, err := s.rollbar.GetItemData(ctx, counter, token)
+	if err != nil {
+		return nil, err
+	}
+	s.items.Add(key, item)
+	return item, nil
+}
+
+// getOccurrence returns the occurrence from the cache, or fetches it if it's not cached.
+// Occurrences never change once reported, so they don't expire.
+func (s *server) getOccurrence(ctx context.Context, team, project string, id int64, token string) (*rollbar.Occurrence, error) {
+	key := s.occurrenceCacheKey(team, project, id)
+	if occurrence, ok := s.occurrences.Get(key); ok {
+		return occurrence.(*rollbar.Occurrence), nil
+	}
+	if config.PersistOccurrenceCache {
+		if b := s.store.GetCachedOccurrence(team, key); b != nil {
+			var occurrence rollbar.Occurrence
+			if err := json.Unmarshal(b, &occurrence); err == nil {
+				persistedOccurrenceHits.Add(1)
+				s.occurrences.Add(key, &occurrence)
+				return &occurrence, nil
+			}
+		}
+	}
+
+	occurrence, err := s.rollbar.GetOccurrenceData(ctx, id, token)
+	if err != nil {
+		return nil, err
+	}
+	s.occurrences.Add(key, occurrence)
+	if config.PersistOccurrenceCache {
+		b, err := json.Marshal(occurrence)
+		if err != nil {
+			log.Printf("Could not serialize occurrence %s: %s", key, err.Error())
+		} else {
+			s.store.SaveCachedOccurrence(team, key, b)
+		}
+	}
+	return occurrence, nil
+}
+
+// pruneCachedOccurrences removes the occurrences that have been kept in the database for longer
+// than ttl, every occurrencePruneInterval. It returns once quit is closed.
+func (s *server) pruneCachedOccurrences(ttl time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(occurrencePruneInterval)
+	defer ticker.Stop()
+	for {
+		if removed := s.store.DeleteCachedOccurrencesBefore(time.Now().Add(-ttl)); removed > 0 {
+			log.Printf("Pruned %d cached occurrences", removed)
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
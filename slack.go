@@ -1,48 +1,38 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"errors"
+	"expvar"
 
-	"./db"
 	"./rollbar"
+	"./slack"
 )
 
 const (
-	slackUnfurlURL      = "https://slack.com/api/chat.unfurl"
-	slackOauthAccessURL = "https://slack.com/api/oauth.access"
 	maxStacktraceFrames = 10
+	// how many links of a single message are fetched from Rollbar at once
+	maxConcurrentFetches = 4
 )
 
-type slackOauthAccessResponse struct {
-	OK          bool
-	Error       string
-	AccessToken string `json:"access_token"`
-	Scope       string
-	UserID      string `json:"user_id"`
-	TeamName    string `json:"team_name"`
-	TeamID      string `json:"team_id"`
-}
-
-type slackUnfurlPayload struct {
-	Token   string
-	Channel string
-	TS      string
-	Unfurls string
-}
+const (
+	// team setting selecting how unfurls are rendered
+	unfurlFormatSetting     = "unfurl_format"
+	unfurlFormatBlocks      = "blocks"
+	unfurlFormatAttachments = "attachments"
+)
 
 type slackAttachment struct {
-	//Text string
+	Text     string                 `json:"text,omitempty"`
 	Fallback string                 `json:"fallback"`
 	Title    string                 `json:"title"`
 	TS       int64                  `json:"ts"`
@@ -79,27 +69,11 @@ type slackEvent struct {
 	//tokens_revoked-specific fields
 	Tokens struct {
 		OAuth []string
+		Bot   []string
 	}
 }
 
-func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	code := r.FormValue("code")
-	if code != "" {
-		err := exchangeOauthCodeForToken(code)
-		if err != nil {
-			// serve error page?
-		}
-	}
-	serveFile(w, "static/thanks.html")
-}
-
-func slashCommandHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.FormValue("token")
-	if token != config.SlackVerificationToken {
-		log.Printf("Token %s did not match the configured one at /slash", token)
-		http.Error(w, "Token mismatch", 403)
-		return
-	}
+func (s *server) slashCommandHandler(w http.ResponseWriter, r *http.Request) {
 	team := r.FormValue("team_id")
 	user := r.FormValue("user_id")
 	command := r.FormValue("command")
@@ -107,7 +81,7 @@ func slashCommandHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Received slash command (team %s, user %s): %s %s", team, user, command, text)
 	switch command {
 	case "/rollbar":
-		processRollbarSlashCommand(w, text, team)
+		s.processRollbarSlashCommand(r.Context(), w, text, team, user)
 	default:
 		log.Printf("Unsupported slack command %s", command)
 	}
@@ -121,29 +95,49 @@ type slackSlashCommandResponse struct {
 const (
 	rollbarCmdUsage = "Usage:\n" +
 		"`/rollbar set <project url> <project token>` - set read access token for project\n" +
-		"`/rollbar clear <project url>` - clear access token for project\n" +
-		"`/rollbar list` - list all projects that I will unfurl\n\n" +
+		"`/rollbar set-write <project url> <project token>` - set write access token for project, " +
+		"which enables the Resolve/Mute/Reopen buttons\n" +
+		"`/rollbar clear <project url>` - clear access tokens for project\n" +
+		"`/rollbar user <@slack user> <rollbar user id>` - let me assign items to this user\n" +
+		"`/rollbar list` - list all projects that I will unfurl\n" +
+		"`/rollbar format <blocks|attachments>` - choose how previews are rendered\n\n" +
 		"For example: `/rollbar set https://rollbar.com/MyOrganization/MyProject/ abcdef12345`"
 	rollbarInvalidProjectURL = "Sorry, %s doesn't look like a Rollbar project URL. It should look like this: " +
 		"https://rollbar.com/MyOrganization/MyProject/"
 	rollbarInvalidToken = "Sorry, Rollbar reports %s is not a valid access token. Please copy the _read_ token from " +
 		"https://rollbar.com/%s/settings/access_tokens/"
+	rollbarInvalidWriteToken = "Sorry, Rollbar reports %s is not a valid access token. Please copy the _write_ token from " +
+		"https://rollbar.com/%s/settings/access_tokens/"
+	rollbarWrongProject = "Sorry, %s is a token of the Rollbar project *%s*, not %s. Please copy the _%s_ token from " +
+		"https://rollbar.com/%s/settings/access_tokens/"
+	rollbarProjectUnverified = "\nI couldn't check with Rollbar that the token belongs to this project, " +
+		"so please make sure you copied it from https://rollbar.com/%s/settings/access_tokens/"
+	rollbarAccountUnverified = "\nI checked that the token belongs to a Rollbar project named *%s*. Rollbar doesn't tell " +
+		"which account it is in, so please make sure you copied it from https://rollbar.com/%s/settings/access_tokens/"
+	rollbarOtherTokenProject = "Sorry, %s belongs to a different Rollbar project than the %s token I have for " +
+		"https://rollbar.com/%s/. Use `/rollbar clear` first if you want to switch projects."
 	rollbarTokenAdded           = "Thanks! I will now unfurl links from https://rollbar.com/%s/items/ for you."
+	rollbarWriteTokenAdded      = "Thanks! Previews of https://rollbar.com/%s/items/ will now let you change the item status."
 	rollbarTokenRemoved         = "Done! I will no longer unfurl links from https://rollbar.com/%s/items/."
 	rollbarGeneralError         = "An error occurred while executing the command. Please try again!"
 	rollbarNoProjectsConfigured = "No  Rollbar projects have been configured for your team.\n" +
 		"Use `/rollbar set` to add one."
-	rollbarProjectList = "I will unfurl links from the following projects:\n%s"
+	rollbarProjectList  = "I will unfurl links from the following projects:\n%s"
+	rollbarFormatSet    = "Done! Previews will now be rendered as %s."
+	rollbarUserMapped   = "Done! Items assigned to <@%s> in Slack will be assigned to Rollbar user #%s."
+	rollbarUnknownUser  = "Sorry, I don't know who <@%s> is in Rollbar. Use `/rollbar user` to tell me."
+	rollbarNoWriteToken = "Sorry, I can't change items of https://rollbar.com/%s/ without a write token. " +
+		"Use `/rollbar set-write` to add one."
 )
 
-func processRollbarSlashCommand(w http.ResponseWriter, commandText, team string) {
+func (s *server) processRollbarSlashCommand(ctx context.Context, w http.ResponseWriter, commandText, team, user string) {
 	resp := slackSlashCommandResponse{
 		ResponseType: "ephemeral",
 	}
 	parts := strings.Split(commandText, " ")
 	switch parts[0] {
 	case "list":
-		projects := db.GetProjects(team)
+		projects := s.store.GetProjects(team)
 		for k, p := range projects {
 			projects[k] = fmt.Sprintf("https://rollbar.com/%s/", p)
 		}
@@ -165,17 +159,42 @@ func processRollbarSlashCommand(w http.ResponseWriter, commandText, team string)
 		}
 		project := strings.ToLower(matches[1])
 		token := parts[2]
-		if !rollbar.IsValidToken(token) {
-			resp.Text = fmt.Sprintf(rollbarInvalidToken, token, project)
+		projectID, refusal := s.verifyProjectToken(ctx, team, project, token, false)
+		if refusal != "" {
+			resp.Text = refusal
 			break
 		}
 		//finally, all is well
-		err := db.SaveProjectToken(team, project, token)
+		err := s.store.SaveProjectToken(team, project, token, user, projectID)
+		if err != nil {
+			resp.Text = rollbarGeneralError
+			break
+		}
+		resp.Text = fmt.Sprintf(rollbarTokenAdded, project) + projectCheckNote(project, projectID)
+	case "set-write":
+		if len(parts) != 3 {
+			resp.Text = rollbarCmdUsage
+			break
+		}
+		projectURL := parts[1]
+		matches := rollbarProjectRegex.FindStringSubmatch(projectURL)
+		if len(matches) != 3 {
+			resp.Text = fmt.Sprintf(rollbarInvalidProjectURL, projectURL)
+			break
+		}
+		project := strings.ToLower(matches[1])
+		token := parts[2]
+		projectID, refusal := s.verifyProjectToken(ctx, team, project, token, true)
+		if refusal != "" {
+			resp.Text = refusal
+			break
+		}
+		err := s.store.SaveProjectWriteToken(team, project, token, user, projectID)
 		if err != nil {
 			resp.Text = rollbarGeneralError
 			break
 		}
-		resp.Text = fmt.Sprintf(rollbarTokenAdded, project)
+		resp.Text = fmt.Sprintf(rollbarWriteTokenAdded, project) + projectCheckNote(project, projectID)
 	case "clear":
 		if len(parts) != 2 {
 			resp.Text = rollbarCmdUsage
@@ -188,8 +207,35 @@ func processRollbarSlashCommand(w http.ResponseWriter, commandText, team string)
 			break
 		}
 		project := strings.ToLower(matches[1])
-		db.DeleteProjectToken(team, project)
+		s.store.DeleteProjectToken(team, project)
 		resp.Text = fmt.Sprintf(rollbarTokenRemoved, project)
+	case "user":
+		if len(parts) != 3 {
+			resp.Text = rollbarCmdUsage
+			break
+		}
+		slackUser := parseUserMention(parts[1])
+		if _, err := strconv.Atoi(parts[2]); err != nil || slackUser == "" {
+			resp.Text = rollbarCmdUsage
+			break
+		}
+		err := s.store.SaveRollbarUser(team, slackUser, parts[2])
+		if err != nil {
+			resp.Text = rollbarGeneralError
+			break
+		}
+		resp.Text = fmt.Sprintf(rollbarUserMapped, slackUser, parts[2])
+	case "format":
+		if len(parts) != 2 || (parts[1] != unfurlFormatBlocks && parts[1] != unfurlFormatAttachments) {
+			resp.Text = rollbarCmdUsage
+			break
+		}
+		err := s.store.SaveTeamSetting(team, unfurlFormatSetting, parts[1])
+		if err != nil {
+			resp.Text = rollbarGeneralError
+			break
+		}
+		resp.Text = fmt.Sprintf(rollbarFormatSet, parts[1])
 	default:
 		resp.Text = rollbarCmdUsage
 	}
@@ -199,40 +245,66 @@ func processRollbarSlashCommand(w http.ResponseWriter, commandText, team string)
 	w.Write(b)
 }
 
-func exchangeOauthCodeForToken(code string) error {
-	form := url.Values{}
-	form.Add("client_id", config.ClientID)
-	form.Add("client_secret", config.ClientSecret)
-	form.Add("code", code)
-
-	log.Print("Posting oauth.access")
-
-	resp, err := http.PostForm(slackOauthAccessURL, form)
-	if err != nil {
-		log.Printf("error when posting oauth.access: %s", err.Error())
-		return err
+// verifyProjectToken checks that token belongs to project (Organization/Project) as far as Rollbar
+// tells: project tokens show the name of their project, but not the name of its account. It returns
+// the ID of the Rollbar project, 0 if Rollbar wouldn't tell, or the reply to send instead if the token
+// can't be used.
+func (s *server) verifyProjectToken(ctx context.Context, team, project, token string, write bool) (int, string) {
+	kind, invalid, otherKind := "read", rollbarInvalidToken, "write"
+	if write {
+		kind, invalid, otherKind = "write", rollbarInvalidWriteToken, "read"
 	}
-	defer resp.Body.Close()
-	var oauthResponse slackOauthAccessResponse
-	err = json.NewDecoder(resp.Body).Decode(&oauthResponse)
-	if err != nil {
-		log.Printf("error when deserializing oauth.access response: %s", err.Error())
-		return err
+	rollbarProject, err := s.rollbar.GetProject(ctx, token)
+	if err == rollbar.ErrInvalidToken {
+		return 0, fmt.Sprintf(invalid, token, project)
 	}
-	if !oauthResponse.OK {
-		log.Printf("oauth.access reported an error: %s", oauthResponse.Error)
-		return errors.New(oauthResponse.Error)
+	if _, ok := err.(*rollbar.APIError); ok {
+		//Rollbar accepts the token but won't show the project, e.g. to a write-only token
+		log.Printf("Could not look up the project of a token for %s: %s", project, err.Error())
+		return 0, ""
 	}
-	err = db.SaveAuthToken(oauthResponse.TeamID, oauthResponse.UserID, oauthResponse.AccessToken)
 	if err != nil {
-		log.Printf("Could not save auth token: %s", err.Error())
-		return err
+		log.Printf("Could not verify a token for %s: %s", project, err.Error())
+		return 0, rollbarGeneralError
 	}
-	log.Printf("Saved auth token for user %s/team %s (%s)", oauthResponse.UserID, oauthResponse.TeamID, oauthResponse.TeamName)
-	return nil
+	if !strings.EqualFold(rollbarProject.Name, projectName(project)) {
+		log.Printf("Refused a token of project %s (%d) for %s", rollbarProject.Name, rollbarProject.ID, project)
+		return 0, fmt.Sprintf(rollbarWrongProject, token, rollbarProject.Name, project, kind, project)
+	}
+	//items are read with the read token and changed with the write token, they have to agree
+	other := s.store.GetProjectTokenStatus(team, project, !write)
+	if other.ProjectID != 0 && other.ProjectID != rollbarProject.ID {
+		log.Printf("Refused a token of project %d for %s, its %s token is of project %d", rollbarProject.ID, project, otherKind, other.ProjectID)
+		return 0, fmt.Sprintf(rollbarOtherTokenProject, token, otherKind, project)
+	}
+	return rollbarProject.ID, ""
+}
+
+// projectName returns the name of the project in a project slug (Organization/Project)
+func projectName(project string) string {
+	return project[strings.Index(project, "/")+1:]
 }
 
-func slackEventHandler(w http.ResponseWriter, r *http.Request) {
+// projectCheckNote tells the user how far Rollbar let us check the project of a token
+func projectCheckNote(project string, projectID int) string {
+	if projectID == 0 {
+		return fmt.Sprintf(rollbarProjectUnverified, project)
+	}
+	return fmt.Sprintf(rollbarAccountUnverified, projectName(project), project)
+}
+
+var userMentionRegex = regexp.MustCompile(`^<@([A-Z0-9]+)(\|[^>]*)?>$`)
+
+// parseUserMention returns the user ID from an escaped mention like <@U012ABC|name>
+func parseUserMention(mention string) string {
+	matches := userMentionRegex.FindStringSubmatch(mention)
+	if len(matches) < 2 {
+		return ""
+	}
+	return matches[1]
+}
+
+func (s *server) slackEventHandler(w http.ResponseWriter, r *http.Request) {
 	event := new(slackOuterEvent)
 
 	err := json.NewDecoder(r.Body).Decode(&event)
@@ -242,15 +314,19 @@ func slackEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if event.Token != config.SlackVerificationToken {
-		log.Printf("Request verification token %s did not match the one configured!", event.Token)
-		http.Error(w, "Token mismatch", 403)
-		return
-	}
-
 	team := event.TeamID
 	log.Printf("Received event of type %s/%s from team %s", event.Type, event.Event.Type, team)
 
+	if retryNum := r.Header.Get(slackRetryNumHeader); retryNum != "" {
+		log.Printf("Event %s is retry #%s (%s)", event.EventID, retryNum, r.Header.Get(slackRetryReasonHeader))
+	}
+	if event.EventID != "" {
+		if !s.events.claim(event.EventID) {
+			log.Printf("Dropping duplicate event %s from team %s", event.EventID, team)
+			return
+		}
+	}
+
 	switch event.Type {
 	case "url_verification":
 		processURLVerification(w, event)
@@ -258,11 +334,16 @@ func slackEventHandler(w http.ResponseWriter, r *http.Request) {
 		innerEventType := event.Event.Type
 		switch innerEventType {
 		case "link_shared":
-			processLinkSharedEvent(&event.Event, team)
+			if err := s.processLinkSharedEvent(&event.Event, team); err != nil {
+				// let Slack retry the event later
+				s.events.release(event.EventID)
+				http.Error(w, "Could not process event", 503)
+				return
+			}
 		case "tokens_revoked":
-			processTokensRevokedEvent(&event.Event, team)
+			s.processTokensRevokedEvent(&event.Event, team)
 		case "app_uninstalled":
-			processAppUninstalledEvent(team)
+			s.processAppUninstalledEvent(team)
 		default:
 			log.Printf("Unsupported event subtype %s", innerEventType)
 		}
@@ -273,25 +354,42 @@ func slackEventHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func processLinkSharedEvent(e *slackEvent, team string) {
+func (s *server) processLinkSharedEvent(e *slackEvent, team string) error {
 	logLine := fmt.Sprintf("link shared event (channel=%s,ts=%s), links:\n", e.Channel, e.MessageTS)
 	for _, v := range e.Links {
 		logLine += fmt.Sprintf("-- %s\n", v.URL)
 	}
 	log.Print(logLine)
-	go addLinkPreviews(e, team)
+
+	job := unfurlJob{
+		Team:      team,
+		Channel:   e.Channel,
+		MessageTS: e.MessageTS,
+	}
+	for _, v := range e.Links {
+		job.Links = append(job.Links, v.URL)
+	}
+	err := s.queue.Enqueue(unfurlJobType, job)
+	if err != nil {
+		log.Printf("Could not queue unfurls (channel=%s,ts=%s): %s", e.Channel, e.MessageTS, err.Error())
+	}
+	return err
 }
 
-func processTokensRevokedEvent(e *slackEvent, team string) {
+func (s *server) processTokensRevokedEvent(e *slackEvent, team string) {
 	for _, v := range e.Tokens.OAuth {
 		log.Printf("Deleting oAuth token for user %s (team %s) ", v, team)
-		db.DeleteUserToken(team, v)
+		s.store.DeleteUserToken(team, v)
+	}
+	if len(e.Tokens.Bot) > 0 {
+		log.Printf("Deleting bot token (team %s)", team)
+		s.store.DeleteBotToken(team)
 	}
 }
 
-func processAppUninstalledEvent(team string) {
+func (s *server) processAppUninstalledEvent(team string) {
 	log.Printf("Deleting team %s's data", team)
-	db.DeleteTeam(team)
+	s.store.DeleteTeam(team)
 }
 
 func processURLVerification(w http.ResponseWriter, e *slackOuterEvent) {
@@ -299,65 +397,320 @@ func processURLVerification(w http.ResponseWriter, e *slackOuterEvent) {
 	fmt.Fprintf(w, "%s", e.Challenge)
 }
 
-var rollbarItemRegex = regexp.MustCompile(`([a-zA-Z0-9_\-\.]+\/[a-zA-Z0-9_\-\.]+)\/items\/(\d+)/?`)
-var rollbarProjectRegex = regexp.MustCompile(`https?:\/\/rollbar.com\/([a-zA-Z0-9_\-\.]+\/[a-zA-Z0-9_\-\.]+)($|\/?.*)`)
+// itemUnfurl is everything needed to render a preview of a Rollbar item link
+type itemUnfurl struct {
+	URL        string
+	Item       *rollbar.Item
+	Occurrence *rollbar.Occurrence
+	// whether the item can be changed from Slack, i.e. the project has a write token
+	Interactive bool
+	// Slack user the item is assigned to, if the assignee is mapped to one
+	AssigneeSlackUser string
+	// optional line saying who last changed the item from Slack
+	Note string
+}
+
+// Assignee describes who the item is assigned to, in mrkdwn
+func (u *itemUnfurl) Assignee() string {
+	switch {
+	case u.Item.AssignedUserID == nil:
+		return "Unassigned"
+	case u.AssigneeSlackUser != "":
+		return fmt.Sprintf("<@%s>", u.AssigneeSlackUser)
+	default:
+		return fmt.Sprintf("Rollbar user #%d", *u.Item.AssignedUserID)
+	}
+}
 
-func addLinkPreviews(event *slackEvent, team string) {
-	linkData := make(map[string]slackAttachment)
-	for _, link := range event.Links {
-		url := link.URL
-		matches := rollbarItemRegex.FindStringSubmatch(url)
-		if len(matches) < 3 {
-			log.Printf("%s is not a Rollbar item link", url)
+// addLinkPreviews unfurls the links of a message. It fails if none of the links could be
+// unfurled because of an error that may go away if tried again later.
+func (s *server) addLinkPreviews(ctx context.Context, job *unfurlJob) error {
+	// whatever isn't ready by the deadline is left out, a late preview is as good as none.
+	// The deadline is only for fetching, what is ready still has to be posted after it.
+	fetchCtx, cancel := context.WithTimeout(ctx, config.UnfurlDeadline)
+	defer cancel()
+
+	format := s.getUnfurlFormat(job.Team)
+	type result struct {
+		url    string
+		unfurl interface{}
+		err    error
+	}
+	results := make(chan result, len(job.Links))
+	limit := make(chan struct{}, maxConcurrentFetches)
+	seen := make(map[string]bool)
+	for _, url := range job.Links {
+		if seen[url] {
 			continue
 		}
-		project := strings.ToLower(matches[1])
-		counter := matches[2]
-		token := db.GetProjectToken(team, project)
-		if token == "" {
-			log.Printf("Project %s isn't configured for team %s", project, team)
-			continue
+		seen[url] = true
+		go func(url string) {
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			unfurl, err := s.getLinkUnfurl(fetchCtx, url, job.Team, format)
+			results <- result{url, unfurl, err}
+		}(url)
+	}
+
+	linkData := make(map[string]interface{})
+	var transientErr error
+	for pending := len(seen); pending > 0; pending-- {
+		r := <-results
+		if r.unfurl != nil {
+			linkData[r.url] = r.unfurl
 		}
-		item, err := rollbar.GetItemData(counter, token)
+		if r.err != nil {
+			transientErr = r.err
+		}
+	}
+
+	if len(linkData) == 0 {
+		//none of the links posted were able to be processed
+		log.Printf("No links processed (channel=%s,ts=%s)", job.Channel, job.MessageTS)
+		return transientErr
+	}
+
+	return s.postUnfurls(ctx, job.Team, job.Channel, job.MessageTS, linkData)
+}
+
+// getLinkUnfurl renders a preview for url in the given format. Returns nil if the link can't be unfurled,
+// along with the reason if it is likely to be unfurled when tried again.
+func (s *server) getLinkUnfurl(ctx context.Context, url, team, format string) (interface{}, error) {
+	link, ok := parseRollbarLink(url)
+	if !ok {
+		log.Printf("%s is not a Rollbar link I can unfurl", url)
+		return nil, nil
+	}
+	unfurl, err := s.renderLinkUnfurl(ctx, link, team, format)
+	switch {
+	case err == rollbar.ErrRateLimited:
+		// let people know why there's no preview, rather than silently showing nothing
+		log.Printf("Rate limited by Rollbar while unfurling %s", url)
+		return renderSummaryUnfurl(&summaryUnfurl{
+			Title:   "Preview unavailable",
+			Text:    "Rollbar's API rate limit for this project has been reached. Please try again in a few minutes.",
+			Context: link.Project,
+		}, format), nil
+	case err != nil:
+		log.Printf("Could not unfurl %s: %s", url, err.Error())
+		if isTransient(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return unfurl, nil
+}
+
+func (s *server) renderLinkUnfurl(ctx context.Context, link *rollbarLink, team, format string) (interface{}, error) {
+	switch link.Kind {
+	case occurrenceLink:
+		unfurl, err := s.getOccurrenceUnfurl(ctx, link, team)
 		if err != nil {
-			log.Printf("error getting data for %s: %s", link.URL, err.Error())
-			continue
+			return nil, err
+		}
+		return renderOccurrenceUnfurl(unfurl, format), nil
+	case deployLink:
+		unfurl, err := s.getDeployUnfurl(ctx, link, team)
+		if err != nil {
+			return nil, err
 		}
-		//TODO: the occurrence data should be cached as it is less or more immutable
-		occurrence, err := rollbar.GetOccurrenceData(item.ActivatingOccurrenceID, token)
+		return renderSummaryUnfurl(unfurl, format), nil
+	case versionLink:
+		unfurl, err := s.getVersionUnfurl(ctx, link, team)
 		if err != nil {
-			log.Printf("couldn't fetch occurrence data for %s: %s", link.URL, err.Error())
-			//don't continue as we have the item info, even if without stack trace
+			return nil, err
 		}
-		linkData[link.URL] = getUnfurlData(item, occurrence)
+		return renderSummaryUnfurl(unfurl, format), nil
+	case dashboardLink:
+		unfurl, err := s.getDashboardUnfurl(ctx, link, team)
+		if err != nil {
+			return nil, err
+		}
+		return renderSummaryUnfurl(unfurl, format), nil
+	default:
+		unfurl, err := s.getItemUnfurl(ctx, link, team)
+		if err != nil {
+			return nil, err
+		}
+		return renderItemUnfurl(unfurl, format), nil
 	}
+}
 
-	if len(linkData) == 0 {
-		//none of the links posted were able to be processed
-		log.Printf("No links processed (channel=%s,ts=%s)", event.Channel, event.MessageTS)
-		return
+type projectNotConfiguredError struct {
+	project, team string
+}
+
+func (e *projectNotConfiguredError) Error() string {
+	return fmt.Sprintf("project %s isn't configured for team %s", e.project, e.team)
+}
+
+func errProjectNotConfigured(project, team string) error {
+	return &projectNotConfiguredError{project: project, team: team}
+}
+
+// isTransient tells if an unfurl failed because of something that may go away by itself,
+// like a network error, rather than e.g. a missing token or an item that doesn't exist
+func isTransient(err error) bool {
+	switch err.(type) {
+	case *rollbar.APIError, *projectNotConfiguredError:
+		return false
+	}
+	return true
+}
+
+// getItemUnfurl fetches the data needed to unfurl an item link
+func (s *server) getItemUnfurl(ctx context.Context, link *rollbarLink, team string) (*itemUnfurl, error) {
+	url, project, counter := link.URL, link.Project, link.Counter
+	token := s.store.GetProjectToken(team, project)
+	if token == "" {
+		return nil, errProjectNotConfigured(project, team)
+	}
+	item, err := s.getItem(ctx, team, project, counter, token)
+	if err != nil {
+		return nil, err
+	}
+	occurrence, err := s.getOccurrence(ctx, team, project, item.ActivatingOccurrenceID, token)
+	if err != nil {
+		log.Printf("couldn't fetch occurrence data for %s: %s", url, err.Error())
+		//don't bail out as we have the item info, even if without stack trace
+	}
+	unfurl := &itemUnfurl{
+		URL:         url,
+		Item:        item,
+		Occurrence:  occurrence,
+		Interactive: s.store.GetProjectWriteToken(team, project) != "",
+	}
+	if item.AssignedUserID != nil {
+		unfurl.AssigneeSlackUser = s.store.GetSlackUser(team, strconv.Itoa(*item.AssignedUserID))
+	}
+	return unfurl, nil
+}
+
+// occurrenceUnfurl is everything needed to render a preview of a Rollbar occurrence link
+type occurrenceUnfurl struct {
+	URL        string
+	Item       *rollbar.Item
+	Occurrence *rollbar.Occurrence
+}
+
+// getOccurrenceUnfurl fetches the data needed to unfurl an occurrence link
+func (s *server) getOccurrenceUnfurl(ctx context.Context, link *rollbarLink, team string) (*occurrenceUnfurl, error) {
+	token := s.store.GetProjectToken(team, link.Project)
+	if token == "" {
+		return nil, errProjectNotConfigured(link.Project, team)
+	}
+	// the occurrence ID is in the URL, so there is no need to wait for the item
+	var occurrence *rollbar.Occurrence
+	var occurrenceErr error
+	done := make(chan struct{})
+	go func() {
+		occurrence, occurrenceErr = s.getOccurrence(ctx, team, link.Project, link.OccurrenceID, token)
+		close(done)
+	}()
+	item, err := s.getItem(ctx, team, link.Project, link.Counter, token)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	//unlike item links, the occurrence is the whole point of the preview
+	if occurrenceErr != nil {
+		return nil, occurrenceErr
+	}
+	return &occurrenceUnfurl{
+		URL:        link.URL,
+		Item:       item,
+		Occurrence: occurrence,
+	}, nil
+}
+
+func renderOccurrenceUnfurl(unfurl *occurrenceUnfurl, format string) interface{} {
+	if format == unfurlFormatAttachments {
+		return getOccurrenceUnfurlData(unfurl)
+	}
+	return getOccurrenceUnfurlBlocks(unfurl)
+}
+
+// summaryUnfurl is a preview of a Rollbar page that boils down to a title and a few facts
+type summaryUnfurl struct {
+	Title string
+	// values are mrkdwn, text coming from Rollbar has to be escaped
+	Fields []slackAttachmentField
+	// optional mrkdwn shown above the fields
+	Text string
+	// shown in small print under the fields
+	Context string
+}
+
+func renderSummaryUnfurl(unfurl *summaryUnfurl, format string) interface{} {
+	if format == unfurlFormatAttachments {
+		return getSummaryUnfurlData(unfurl)
+	}
+	return getSummaryUnfurlBlocks(unfurl)
+}
+
+func renderItemUnfurl(unfurl *itemUnfurl, format string) interface{} {
+	if format == unfurlFormatAttachments {
+		return getUnfurlData(unfurl)
 	}
+	return getUnfurlBlocks(unfurl)
+}
+
+var errNoAuthToken = errors.New("no oAuth token stored")
 
+// outcomes of chat.unfurl calls, by Slack error code
+var unfurlResults = expvar.NewMap("slack_unfurls")
+
+// postUnfurls attaches the rendered previews in linkData to the message identified by channel and ts.
+// The tokens of the team are tried in turn until one is accepted. Tokens Slack rejects are marked as
+// failing, or removed if they were revoked.
+func (s *server) postUnfurls(ctx context.Context, team, channel, ts string, linkData map[string]interface{}) error {
 	unfurls, err := json.Marshal(linkData)
 	if err != nil {
-		log.Printf("Unfurls serialization failed (channel=%s,ts=%s): %s", event.Channel, event.MessageTS, err.Error())
-		return
+		log.Printf("Unfurls serialization failed (channel=%s,ts=%s): %s", channel, ts, err.Error())
+		return err
 	}
 
-	apiToken := db.GetAuthToken(team)
-	if apiToken == "" {
+	tokens := s.store.GetAuthTokens(team)
+	if len(tokens) == 0 {
 		log.Printf("Couldn't retrieve oAuth token for team %s", team)
-		return
+		return errNoAuthToken
 	}
 
-	payload := slackUnfurlPayload{
-		Token:   apiToken,
-		Channel: event.Channel,
-		TS:      event.MessageTS,
-		Unfurls: string(unfurls),
+	for _, token := range tokens {
+		log.Printf("Posting chat.unfurl (channel=%s,ts=%s,token of %s)", channel, ts, token.Owner)
+		err = s.slack.UnfurlLinks(ctx, token.Token, channel, ts, string(unfurls))
+		if err == nil {
+			unfurlResults.Add("ok", 1)
+			s.store.MarkAuthTokenWorking(team, token.Owner)
+			return nil
+		}
+
+		code := slack.ErrorCode(err)
+		if code == "" {
+			code = "request_failed"
+		}
+		unfurlResults.Add(code, 1)
+		log.Printf("chat.unfurl failed (team=%s,channel=%s,ts=%s): %s", team, channel, ts, err.Error())
+		switch {
+		case code == slack.ErrTokenRevoked:
+			log.Printf("Removing the revoked token of %s (team %s)", token.Owner, team)
+			s.store.DeleteAuthToken(team, token.Token)
+		case slack.IsAuthError(err):
+			log.Printf("Marking the token of %s as failing (team %s)", token.Owner, team)
+			s.store.MarkAuthTokenFailing(team, token.Owner, code)
+		default:
+			return err
+		}
 	}
+	return err
+}
 
-	postToSlack(payload)
+func (s *server) getUnfurlFormat(team string) string {
+	format := s.store.GetTeamSetting(team, unfurlFormatSetting)
+	if format == "" {
+		return unfurlFormatBlocks
+	}
+	return format
 }
 
 func getTimeAgoString(d time.Duration) string {
@@ -380,18 +733,19 @@ func getTimeAgoString(d time.Duration) string {
 	return fmt.Sprintf("%.fd ago", t)
 }
 
-func getUnfurlData(item *rollbar.Item, occurrence *rollbar.Occurrence) slackAttachment {
+func getUnfurlData(unfurl *itemUnfurl) slackAttachment {
+	item := unfurl.Item
 	now := time.Now()
 	attachment := slackAttachment{
-		Title:    item.Title,
+		Title:    escapeMrkdwn(item.Title),
 		Fallback: item.Title,
 		TS:       now.Unix(),
-		Fields:   make([]slackAttachmentField, 5),
+		Fields:   make([]slackAttachmentField, 5, 6),
 	}
 
 	attachment.Fields[0] = slackAttachmentField{
 		Title: "Status",
-		Value: item.Status,
+		Value: escapeMrkdwn(item.Status),
 		Short: true,
 	}
 	attachment.Fields[1] = slackAttachmentField{
@@ -410,47 +764,116 @@ func getUnfurlData(item *rollbar.Item, occurrence *rollbar.Occurrence) slackAtta
 		Value: getTimeAgoString(lastSeenAgo),
 		Short: true,
 	}
+	attachment.Fields[4] = slackAttachmentField{
+		Title: "Assigned to",
+		Value: unfurl.Assignee(),
+		Short: true,
+	}
+	attachment.MrkdwnIn = []string{"fields"}
 
-	if occurrence != nil && len(occurrence.Data.Body.TraceChain) > 0 && len(occurrence.Data.Body.TraceChain[0].Frames) > 0 {
-		stacktrace := "```"
-		totalFrames := len(occurrence.Data.Body.TraceChain[0].Frames)
-		for i := 0; i < maxStacktraceFrames; i++ {
-			index := totalFrames - i - 1
-			if index < 0 {
-				break
-			}
-			frame := occurrence.Data.Body.TraceChain[0].Frames[index]
-			stacktrace += fmt.Sprintf("at %s.%s (%s:%d)\n", frame.ClassName, frame.Method, frame.Filename, frame.Lineno)
-		}
-		if totalFrames > maxStacktraceFrames {
-			stacktrace += fmt.Sprintf("(... %d more frames ...)\n", totalFrames-maxStacktraceFrames)
-		}
-		stacktrace += "```"
-		attachment.Fields[4] = slackAttachmentField{
+	if stacktrace := formatStacktrace(unfurl.Occurrence); stacktrace != "" {
+		attachment.Fields = append(attachment.Fields, slackAttachmentField{
 			Title: "Stack trace",
-			Value: stacktrace,
+			Value: "```" + stacktrace + "```",
 			Short: false,
-		}
-		attachment.MrkdwnIn = []string{"fields"}
+		})
 	}
 
 	return attachment
 }
 
-func postToSlack(message slackUnfurlPayload) {
-	form := url.Values{}
-	form.Add("token", message.Token)
-	form.Add("channel", message.Channel)
-	form.Add("ts", message.TS)
-	form.Add("unfurls", message.Unfurls)
+// getOccurrenceFields lists the details of an occurrence worth showing, skipping the ones it doesn't have.
+// The values are mrkdwn.
+func getOccurrenceFields(occurrence *rollbar.Occurrence) []slackAttachmentField {
+	data := occurrence.Data
+	fields := []slackAttachmentField{{
+		Title: "Occurred at",
+		Value: time.Unix(int64(occurrence.Timestamp), 0).Format("Jan 2 15:04:05"),
+		Short: true,
+	}}
+	if data.Server.Host != "" {
+		fields = append(fields, slackAttachmentField{Title: "Host", Value: escapeMrkdwn(data.Server.Host), Short: true})
+	}
+	if data.Server.CodeVersion != "" {
+		fields = append(fields, slackAttachmentField{Title: "Code version", Value: escapeMrkdwn(data.Server.CodeVersion), Short: true})
+	}
+	if person := formatPerson(occurrence); person != "" {
+		fields = append(fields, slackAttachmentField{Title: "Person", Value: escapeMrkdwn(person), Short: true})
+	}
+	if data.Request.URL != "" {
+		fields = append(fields, slackAttachmentField{
+			Title: "Request",
+			Value: escapeMrkdwn(strings.TrimSpace(data.Request.Method + " " + data.Request.URL)),
+			Short: false,
+		})
+	}
+	return fields
+}
+
+func formatPerson(occurrence *rollbar.Occurrence) string {
+	person := occurrence.Data.Person
+	var parts []string
+	if person.Username != "" {
+		parts = append(parts, person.Username)
+	}
+	if person.Email != "" {
+		parts = append(parts, person.Email)
+	}
+	if person.ID != nil {
+		parts = append(parts, fmt.Sprintf("id %v", person.ID))
+	}
+	return strings.Join(parts, ", ")
+}
 
-	log.Printf("Posting chat.unfurl (channel=%s,ts=%s)", message.Channel, message.TS)
+func getOccurrenceUnfurlData(unfurl *occurrenceUnfurl) slackAttachment {
+	attachment := slackAttachment{
+		Title:    escapeMrkdwn(unfurl.Item.Title),
+		Fallback: unfurl.Item.Title,
+		TS:       time.Now().Unix(),
+		Fields:   getOccurrenceFields(unfurl.Occurrence),
+	}
 
-	resp, err := http.PostForm(slackUnfurlURL, form)
-	if err != nil {
-		log.Printf("error when posting chat.unfurl: %s", err.Error())
+	if stacktrace := formatStacktrace(unfurl.Occurrence); stacktrace != "" {
+		attachment.Fields = append(attachment.Fields, slackAttachmentField{
+			Title: "Stack trace",
+			Value: "```" + stacktrace + "```",
+			Short: false,
+		})
+		attachment.MrkdwnIn = []string{"fields"}
+	}
+
+	return attachment
+}
+
+func getSummaryUnfurlData(unfurl *summaryUnfurl) slackAttachment {
+	return slackAttachment{
+		Title:    escapeMrkdwn(unfurl.Title),
+		Fallback: unfurl.Title,
+		Text:     unfurl.Text,
+		TS:       time.Now().Unix(),
+		Fields:   unfurl.Fields,
+		MrkdwnIn: []string{"text", "fields"},
+	}
+}
+
+// formatStacktrace renders the innermost frames of the occurrence's first trace as mrkdwn,
+// or returns an empty string if there is no trace to show
+func formatStacktrace(occurrence *rollbar.Occurrence) string {
+	if occurrence == nil || len(occurrence.Data.Body.TraceChain) == 0 || len(occurrence.Data.Body.TraceChain[0].Frames) == 0 {
+		return ""
+	}
+	stacktrace := ""
+	totalFrames := len(occurrence.Data.Body.TraceChain[0].Frames)
+	for i := 0; i < maxStacktraceFrames; i++ {
+		index := totalFrames - i - 1
+		if index < 0 {
+			break
+		}
+		frame := occurrence.Data.Body.TraceChain[0].Frames[index]
+		stacktrace += escapeMrkdwn(fmt.Sprintf("at %s.%s (%s:%d)\n", frame.ClassName, frame.Method, frame.Filename, frame.Lineno))
+	}
+	if totalFrames > maxStacktraceFrames {
+		stacktrace += fmt.Sprintf("(... %d more frames ...)\n", totalFrames-maxStacktraceFrames)
 	}
-	defer resp.Body.Close()
-	b, _ := ioutil.ReadAll(resp.Body)
-	log.Printf("chat.unfurl resp: %s", string(b))
+	return stacktrace
 }
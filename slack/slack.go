@@ -0,0 +1,174 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the address of the Slack Web API
+	DefaultBaseURL = "https://slack.com/api"
+	// DefaultTimeout limits how long a single API call may take
+	DefaultTimeout = 10 * time.Second
+)
+
+// Error codes the app reacts to, see the documentation of each method for the full list
+const (
+	ErrInvalidAuth     = "invalid_auth"
+	ErrNotAuthed       = "not_authed"
+	ErrTokenRevoked    = "token_revoked"
+	ErrAccountInactive = "account_inactive"
+	ErrRateLimited     = "ratelimited"
+	ErrCannotUnfurlURL = "cannot_unfurl_url"
+)
+
+// Client calls the Slack Web API
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client for the Slack Web API with the default timeout
+func NewClient() *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// Error is an error reported by the Slack API
+type Error struct {
+	Method string
+	Code   string
+	// set when Slack asks to slow down
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Method, e.Code)
+}
+
+// IsAuthError tells if err means the token used for the call is no good anymore
+func IsAuthError(err error) bool {
+	apiErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	switch apiErr.Code {
+	case ErrInvalidAuth, ErrNotAuthed, ErrTokenRevoked, ErrAccountInactive:
+		return true
+	}
+	return false
+}
+
+// ErrorCode returns the Slack error code of err, or an empty string if it isn't a Slack API error
+func ErrorCode(err error) string {
+	if apiErr, ok := err.(*Error); ok {
+		return apiErr.Code
+	}
+	return ""
+}
+
+type response struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// call posts form to an API method and decodes the response into result, if not nil
+func (c *Client) call(ctx context.Context, method string, form url.Values, result interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(c.BaseURL, "/")+"/"+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &Error{Method: method, Code: ErrRateLimited, RetryAfter: time.Duration(retryAfter) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", method, resp.Status)
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("%s: could not decode response: %s", method, err.Error())
+	}
+	var status response
+	if err := json.Unmarshal(body, &status); err != nil {
+		return fmt.Errorf("%s: could not decode response: %s", method, err.Error())
+	}
+	if !status.OK {
+		return &Error{Method: method, Code: status.Error}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+// UnfurlLinks attaches previews to the links of a message. unfurls is a JSON object
+// mapping each link to its preview.
+func (c *Client) UnfurlLinks(ctx context.Context, token, channel, ts, unfurls string) error {
+	form := url.Values{}
+	form.Add("token", token)
+	form.Add("channel", channel)
+	form.Add("ts", ts)
+	form.Add("unfurls", unfurls)
+	return c.call(ctx, "chat.unfurl", form, nil)
+}
+
+// OAuthV2Response is the result of exchanging an OAuth code with oauth.v2.access
+type OAuthV2Response struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	BotUserID   string `json:"bot_user_id"`
+	AppID       string `json:"app_id"`
+	Team        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"team"`
+	AuthedUser struct {
+		ID string `json:"id"`
+	} `json:"authed_user"`
+}
+
+// OAuthV2Access exchanges the code Slack sent to the OAuth redirect URL for a bot token
+func (c *Client) OAuthV2Access(ctx context.Context, clientID, clientSecret, code string) (*OAuthV2Response, error) {
+	form := url.Values{}
+	form.Add("client_id", clientID)
+	form.Add("client_secret", clientSecret)
+	form.Add("code", code)
+	var result OAuthV2Response
+	if err := c.call(ctx, "oauth.v2.access", form, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostMessage posts a message to a channel. With a bot token, a user ID as channel sends a direct message.
+func (c *Client) PostMessage(ctx context.Context, token, channel, text string) error {
+	form := url.Values{}
+	form.Add("token", token)
+	form.Add("channel", channel)
+	form.Add("text", text)
+	return c.call(ctx, "chat.postMessage", form, nil)
+}
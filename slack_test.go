@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"./db"
+	"./rollbar"
+)
+
+// fakeRollbar answers the project lookup for the tokens in projects, and rejects any other token
+func fakeRollbar(t *testing.T, projects map[string]rollbar.Project) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		project, ok := projects[r.Header.Get(rollbar.TokenHeader)]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"err":1,"message":"invalid access token"}`)
+			return
+		}
+		b, _ := json.Marshal(project)
+		fmt.Fprintf(w, `{"err":0,"result":%s}`, b)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestServer(t *testing.T, projects map[string]rollbar.Project) (*server, db.Store) {
+	store := db.NewMemoryStore()
+	store.SaveBotToken("T1", "B1", "xoxb-1")
+	s := newServer(store)
+	s.rollbar.BaseURL = fakeRollbar(t, projects).URL
+	return s, store
+}
+
+func slashCommand(s *server, team, user, text string) string {
+	form := url.Values{"command": {"/rollbar"}, "team_id": {team}, "user_id": {user}, "text": {text}}
+	r := httptest.NewRequest(http.MethodPost, "/slash", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.slashCommandHandler(w, r)
+
+	var resp slackSlashCommandResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Text
+}
+
+func TestSlashCommandSet(t *testing.T) {
+	s, store := newTestServer(t, map[string]rollbar.Project{
+		"good": {ID: 42, Name: "MyProject"},
+	})
+
+	text := slashCommand(s, "T1", "U1", "set https://rollbar.com/MyOrg/MyProject/ good")
+	if text != fmt.Sprintf(rollbarTokenAdded, "myorg/myproject")+fmt.Sprintf(rollbarAccountUnverified, "myproject", "myorg/myproject") {
+		t.Fatalf("reply = %q", text)
+	}
+	if token := store.GetProjectToken("T1", "myorg/myproject"); token != "good" {
+		t.Errorf("stored token = %q", token)
+	}
+	status := store.GetProjectTokenStatus("T1", "myorg/myproject", false)
+	if status.SetBy != "U1" || status.ProjectID != 42 {
+		t.Errorf("token status = %+v", status)
+	}
+
+	text = slashCommand(s, "T1", "U1", "list")
+	if !strings.Contains(text, "https://rollbar.com/myorg/myproject/") {
+		t.Errorf("list reply = %q", text)
+	}
+}
+
+func TestSlashCommandSetRefusesTokens(t *testing.T) {
+	s, store := newTestServer(t, map[string]rollbar.Project{
+		"other": {ID: 43, Name: "OtherProject"},
+	})
+
+	for _, tt := range []struct {
+		token string
+		reply string
+	}{
+		{"other", fmt.Sprintf(rollbarWrongProject, "other", "OtherProject", "myorg/myproject", "read", "myorg/myproject")},
+		{"bad", fmt.Sprintf(rollbarInvalidToken, "bad", "myorg/myproject")},
+	} {
+		text := slashCommand(s, "T1", "U1", "set https://rollbar.com/MyOrg/MyProject/ "+tt.token)
+		if text != tt.reply {
+			t.Errorf("reply to token %s = %q, want %q", tt.token, text, tt.reply)
+		}
+	}
+	if projects := store.GetProjects("T1"); len(projects) != 0 {
+		t.Errorf("projects after refused tokens = %v", projects)
+	}
+}
+
+func TestSlashCommandSetWriteRefusesOtherProject(t *testing.T) {
+	s, store := newTestServer(t, map[string]rollbar.Project{
+		"read":  {ID: 42, Name: "MyProject"},
+		"write": {ID: 43, Name: "MyProject"},
+	})
+
+	slashCommand(s, "T1", "U1", "set https://rollbar.com/MyOrg/MyProject/ read")
+	text := slashCommand(s, "T1", "U1", "set-write https://rollbar.com/MyOrg/MyProject/ write")
+	if want := fmt.Sprintf(rollbarOtherTokenProject, "write", "read", "myorg/myproject"); text != want {
+		t.Errorf("reply = %q, want %q", text, want)
+	}
+	if token := store.GetProjectWriteToken("T1", "myorg/myproject"); token != "" {
+		t.Errorf("stored write token = %q", token)
+	}
+}
+
+func TestCacheScope(t *testing.T) {
+	s, store := newTestServer(t, map[string]rollbar.Project{
+		"a": {ID: 42, Name: "MyProject"},
+		"b": {ID: 42, Name: "MyProject"},
+		"c": {ID: 43, Name: "MyProject"},
+	})
+	store.SaveBotToken("T2", "B2", "xoxb-2")
+	store.SaveBotToken("T3", "B3", "xoxb-3")
+	store.SaveBotToken("T4", "B4", "xoxb-4")
+	store.SaveProjectToken("T4", "myorg/myproject", "unverified", "U1", 0)
+	for team, token := range map[string]string{"T1": "a", "T2": "b", "T3": "c"} {
+		slashCommand(s, team, "U1", "set https://rollbar.com/MyOrg/MyProject/ "+token)
+	}
+
+	scope := func(team string) string { return s.cacheScope(team, "myorg/myproject") }
+	if scope("T1") != scope("T2") {
+		t.Errorf("teams with tokens of the same project don't share the cache: %q, %q", scope("T1"), scope("T2"))
+	}
+	if scope("T1") == scope("T3") {
+		t.Errorf("teams with tokens of different projects share the cache: %q", scope("T1"))
+	}
+	if scope("T4") == scope("T1") || scope("T4") == scope("T3") {
+		t.Errorf("team with an unverified token shares the cache: %q", scope("T4"))
+	}
+}
+
+func TestSlashCommandUsage(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	for _, text := range []string{"", "set https://rollbar.com/MyOrg/MyProject/", "unknown"} {
+		if reply := slashCommand(s, "T1", "U1", text); reply != rollbarCmdUsage {
+			t.Errorf("reply to %q = %q, want the usage", text, reply)
+		}
+	}
+}
+
+func TestRateLimitedLinkShowsPreviewUnavailable(t *testing.T) {
+	s, store := newTestServer(t, nil)
+	store.SaveProjectToken("T1", "myorg/myproject", "token", "U1", 0)
+	rollbarAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rate-Limit-Limit", "100")
+		w.Header().Set("X-Rate-Limit-Remaining", "0")
+		w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer rollbarAPI.Close()
+	s.rollbar.BaseURL = rollbarAPI.URL
+
+	unfurl, err := s.getLinkUnfurl(context.Background(), "https://rollbar.com/MyOrg/MyProject/items/7/", "T1", unfurlFormatBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, ok := unfurl.(slackBlockUnfurl)
+	if !ok || blocks.Blocks[0].Text.Text != "Preview unavailable" {
+		t.Errorf("unfurl = %+v, want the preview to be unavailable", unfurl)
+	}
+}
+
+func TestLinksReadyByTheDeadlineArePosted(t *testing.T) {
+	s, store := newTestServer(t, nil)
+	store.SaveProjectToken("T1", "myorg/myproject", "token", "U1", 0)
+	rollbarAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/item_by_counter/1":
+			fmt.Fprint(w, `{"err":0,"result":{"id":1,"counter":1,"title":"Fast","status":"active"}}`)
+		case "/item_by_counter/2":
+			//runs past the deadline
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"err":1,"message":"Not found"}`)
+		}
+	}))
+	defer rollbarAPI.Close()
+	s.rollbar.BaseURL = rollbarAPI.URL
+	posted := make(chan string, 1)
+	slackAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- r.FormValue("unfurls")
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	defer slackAPI.Close()
+	s.slack.BaseURL = slackAPI.URL
+	deadline := config.UnfurlDeadline
+	config.UnfurlDeadline = 200 * time.Millisecond
+	defer func() { config.UnfurlDeadline = deadline }()
+
+	fast, slow := "https://rollbar.com/MyOrg/MyProject/items/1/", "https://rollbar.com/MyOrg/MyProject/items/2/"
+	err := s.addLinkPreviews(context.Background(), &unfurlJob{Team: "T1", Channel: "C1", MessageTS: "1.2", Links: []string{fast, slow}})
+	if err != nil {
+		t.Fatalf("err = %v, want the ready link to be posted", err)
+	}
+	select {
+	case unfurls := <-posted:
+		if !strings.Contains(unfurls, fast) || strings.Contains(unfurls, slow) {
+			t.Errorf("posted unfurls = %s, want only %s", unfurls, fast)
+		}
+	default:
+		t.Error("nothing was posted")
+	}
+}
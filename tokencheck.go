@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"./db"
+	"./rollbar"
+)
+
+const rollbarTokenFailing = "Heads up! Rollbar no longer accepts the %s token you set for https://rollbar.com/%s/ for that project, " +
+	"so I can't %s. Use `/rollbar %s` to give me a new one."
+
+// tokenProblem is the reason a stored token no longer works for its project
+type tokenProblem struct {
+	reason string
+}
+
+func (p *tokenProblem) Error() string {
+	return p.reason
+}
+
+// checkProjectToken checks that a stored token still works for the Rollbar project it was set for,
+// projectID if that was known. It returns a *tokenProblem if the token doesn't, or another error
+// if Rollbar couldn't tell.
+func checkProjectToken(ctx context.Context, client *rollbar.Client, token string, projectID int, write bool) error {
+	project, err := client.GetProject(ctx, token)
+	apiErr, isAPIErr := err.(*rollbar.APIError)
+	switch {
+	case err == nil && projectID != 0 && project.ID != projectID:
+		return &tokenProblem{fmt.Sprintf("the token belongs to Rollbar project %d instead of %d", project.ID, projectID)}
+	case err == rollbar.ErrInvalidToken:
+		return &tokenProblem{err.Error()}
+	case isAPIErr && write && projectID == 0:
+		// write-only tokens can't show their project, Rollbar knowing them is all there is to check
+		return nil
+	case isAPIErr:
+		// read tokens have to be able to read, and so do write tokens that once showed their project
+		return &tokenProblem{apiErr.Message}
+	}
+	return err
+}
+
+// scheduleTokenValidation checks the stored Rollbar tokens every interval. The first check is due
+// interval after the latest recorded one, so restarts don't put it off. It returns once quit is closed.
+func (s *server) scheduleTokenValidation(interval time.Duration, quit <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	next := s.lastTokenValidation().Add(interval)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			s.validateProjectTokens(ctx)
+			next = time.Now().Add(interval)
+		case <-quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// lastTokenValidation returns when a stored token was last checked, zero if none ever was
+func (s *server) lastTokenValidation() time.Time {
+	var last time.Time
+	for _, team := range s.store.GetTeams() {
+		for _, project := range s.store.GetProjects(team) {
+			for _, write := range []bool{false, true} {
+				if checked := s.store.GetProjectTokenStatus(team, project, write).LastChecked; checked.After(last) {
+					last = checked
+				}
+			}
+		}
+	}
+	return last
+}
+
+// validateProjectTokens checks every stored Rollbar token and records the outcome
+func (s *server) validateProjectTokens(ctx context.Context) {
+	for _, team := range s.store.GetTeams() {
+		for _, project := range s.store.GetProjects(team) {
+			s.validateProjectToken(ctx, team, project, false)
+			s.validateProjectToken(ctx, team, project, true)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// validateProjectToken checks a token of a project. When it starts failing, e.g. because it was moved
+// to another project, the user who set it is told.
+func (s *server) validateProjectToken(ctx context.Context, team, project string, write bool) {
+	status := s.store.GetProjectTokenStatus(team, project, write)
+	kind, token := "read", s.store.GetProjectToken(team, project)
+	if write {
+		kind, token = "write", s.store.GetProjectWriteToken(team, project)
+	}
+	if token == "" {
+		return
+	}
+
+	err := checkProjectToken(ctx, s.rollbar, token, status.ProjectID, write)
+	if _, failing := err.(*tokenProblem); err != nil && !failing {
+		// not the token's fault, try again next time
+		log.Printf("Could not check the %s token of %s (team %s): %s", kind, project, team, err.Error())
+		return
+	}
+
+	wasFailing := status.Failing()
+	status.LastChecked = time.Now()
+	if err == nil {
+		status.FailingSince = time.Time{}
+		status.LastError = ""
+	} else {
+		if !wasFailing {
+			status.FailingSince = status.LastChecked
+		}
+		status.LastError = err.Error()
+	}
+	if err := s.store.SaveProjectTokenStatus(team, project, write, token, status); err != nil {
+		if err == db.ErrTokenReplaced {
+			log.Printf("The %s token of %s (team %s) was replaced while it was checked", kind, project, team)
+		}
+		return
+	}
+
+	switch {
+	case wasFailing && !status.Failing():
+		log.Printf("The %s token of %s (team %s) works again", kind, project, team)
+	case !wasFailing && status.Failing():
+		log.Printf("The %s token of %s (team %s) is no longer valid", kind, project, team)
+		s.notifyTokenFailing(ctx, team, project, write, status.SetBy)
+	}
+}
+
+// notifyTokenFailing sends a direct message to the user who set a token that stopped working
+func (s *server) notifyTokenFailing(ctx context.Context, team, project string, write bool, user string) {
+	if user == "" {
+		log.Printf("Nobody to notify about the failing token of %s (team %s), it was set before that was recorded", project, team)
+		return
+	}
+	text := fmt.Sprintf(rollbarTokenFailing, "read", project, "unfurl its links", "set")
+	if write {
+		text = fmt.Sprintf(rollbarTokenFailing, "write", project, "change its items", "set-write")
+	}
+
+	// a user token would send the message as the user who installed the app
+	for _, token := range s.store.GetAuthTokens(team) {
+		if token.Owner != db.BotTokenOwner {
+			continue
+		}
+		if err := s.slack.PostMessage(ctx, token.Token, user, text); err != nil {
+			log.Printf("Could not notify %s about the failing token of %s (team %s): %s", user, project, team, err.Error())
+		}
+		return
+	}
+	log.Printf("Could not notify %s about the failing token of %s (team %s): the team has no bot token", user, project, team)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"./db"
+	"./rollbar"
+)
+
+// fakeSlackDMs records the users the bot sent messages to
+func fakeSlackDMs(t *testing.T, s *server) *[]string {
+	var mu sync.Mutex
+	var users []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		users = append(users, r.FormValue("channel"))
+		mu.Unlock()
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	t.Cleanup(server.Close)
+	s.slack.BaseURL = server.URL
+	return &users
+}
+
+func TestFailingTokenIsReportedOnce(t *testing.T) {
+	s, store := newTestServer(t, nil)
+	dms := fakeSlackDMs(t, s)
+	store.SaveProjectToken("T1", "myorg/myproject", "revoked", "U1", 42)
+
+	s.validateProjectTokens(context.Background())
+	s.validateProjectTokens(context.Background())
+	if len(*dms) != 1 || (*dms)[0] != "U1" {
+		t.Errorf("direct messages sent to %v, want one to U1", *dms)
+	}
+	if status := store.GetProjectTokenStatus("T1", "myorg/myproject", false); !status.Failing() || status.LastChecked.IsZero() {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestTokenReplacedWhileChecked(t *testing.T) {
+	var s *server
+	var store db.Store
+	replaced := false
+	rollbarServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the user sets a new token while the old one is being checked
+		if !replaced {
+			replaced = true
+			store.SaveProjectToken("T1", "myorg/myproject", "new", "U2", 42)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"err":1,"message":"invalid access token"}`)
+	}))
+	defer rollbarServer.Close()
+	s, store = newTestServer(t, nil)
+	s.rollbar.BaseURL = rollbarServer.URL
+	dms := fakeSlackDMs(t, s)
+	store.SaveProjectToken("T1", "myorg/myproject", "old", "U1", 42)
+
+	s.validateProjectToken(context.Background(), "T1", "myorg/myproject", false)
+	if len(*dms) != 0 {
+		t.Errorf("direct messages sent to %v about a token that was replaced", *dms)
+	}
+	if status := store.GetProjectTokenStatus("T1", "myorg/myproject", false); status.Failing() || status.SetBy != "U2" {
+		t.Errorf("status of the new token = %+v", status)
+	}
+}
+
+func TestTokenValidationIsDueAfterTheLatestCheck(t *testing.T) {
+	s, store := newTestServer(t, map[string]rollbar.Project{"good": {ID: 42, Name: "MyProject"}})
+	if last := s.lastTokenValidation(); !last.IsZero() {
+		t.Errorf("lastTokenValidation() without tokens = %v", last)
+	}
+	store.SaveProjectToken("T1", "myorg/myproject", "good", "U1", 42)
+	s.validateProjectTokens(context.Background())
+	checked := store.GetProjectTokenStatus("T1", "myorg/myproject", false).LastChecked
+	if last := s.lastTokenValidation(); checked.IsZero() || !last.Equal(checked) {
+		t.Errorf("lastTokenValidation() = %v, want %v", last, checked)
+	}
+}
+
+func TestCheckProjectToken(t *testing.T) {
+	rollbarServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get(rollbar.TokenHeader) {
+		case "moved":
+			fmt.Fprint(w, `{"err":0,"result":{"id":43,"name":"MyProject"}}`)
+		case "no-read-scope":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"err":1,"message":"access token not authorized for this resource"}`)
+		case "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"err":1,"message":"invalid access token"}`)
+		}
+	}))
+	defer rollbarServer.Close()
+	client := rollbar.NewClient()
+	client.BaseURL = rollbarServer.URL
+	client.MaxRetries = 0
+
+	for _, tt := range []struct {
+		name      string
+		token     string
+		projectID int
+		write     bool
+		problem   bool
+	}{
+		{"moved to another project", "moved", 42, false, true},
+		{"project wasn't known", "moved", 0, false, false},
+		{"revoked", "revoked", 42, false, true},
+		{"read token that can't read", "no-read-scope", 0, false, true},
+		{"write-only token", "no-read-scope", 0, true, false},
+		{"write token that could read before", "no-read-scope", 42, true, true},
+		{"Rollbar is down", "down", 42, false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkProjectToken(context.Background(), client, tt.token, tt.projectID, tt.write)
+			if _, problem := err.(*tokenProblem); problem != tt.problem {
+				t.Errorf("err = %#v, want a problem: %v", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestTokenMovedToAnotherProjectIsReported(t *testing.T) {
+	s, store := newTestServer(t, map[string]rollbar.Project{"moved": {ID: 43, Name: "MyProject"}})
+	dms := fakeSlackDMs(t, s)
+	store.SaveProjectToken("T1", "myorg/myproject", "moved", "U1", 42)
+
+	s.validateProjectTokens(context.Background())
+	if len(*dms) != 1 || (*dms)[0] != "U1" {
+		t.Errorf("direct messages sent to %v, want one to U1", *dms)
+	}
+	if status := store.GetProjectTokenStatus("T1", "myorg/myproject", false); !status.Failing() {
+		t.Errorf("status = %+v, want it to be failing", status)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	slackSignatureHeader = "X-Slack-Signature"
+	slackTimestampHeader = "X-Slack-Request-Timestamp"
+	slackSignatureV0     = "v0"
+	// requests older than this are considered replays and rejected
+	slackRequestMaxAge = 5 * time.Minute
+	// Slack payloads are small, anything bigger than this is not from Slack
+	slackMaxBodySize = 1 << 20
+)
+
+// verifySlackRequest wraps a handler for an endpoint Slack posts to. The request is
+// only passed on if it carries a valid signature, or, if legacy verification is enabled
+// and the request is unsigned, a matching verification token.
+func verifySlackRequest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, slackMaxBodySize))
+		if err != nil {
+			log.Printf("Could not read request body at %s: %s", r.URL.Path, err.Error())
+			http.Error(w, "Could not read request", 400)
+			return
+		}
+		r.Body.Close()
+		// let the handler read the body again
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		signature := r.Header.Get(slackSignatureHeader)
+		switch {
+		case signature != "" && config.SlackSigningSecret != "":
+			err = checkSlackSignature(signature, r.Header.Get(slackTimestampHeader), body, time.Now())
+		case config.LegacyTokenVerification:
+			err = checkLegacyToken(body)
+		default:
+			err = fmt.Errorf("request is not signed")
+		}
+		if err != nil {
+			log.Printf("Rejected request at %s: %s", r.URL.Path, err.Error())
+			http.Error(w, "Request verification failed", 403)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkSlackSignature verifies the HMAC-SHA256 signature Slack puts in X-Slack-Signature,
+// see https://api.slack.com/authentication/verifying-requests-from-slack
+func checkSlackSignature(signature, timestamp string, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp %q", timestamp)
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > slackRequestMaxAge || age < -slackRequestMaxAge {
+		return fmt.Errorf("request timestamp %d is outside of the replay window", ts)
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.SlackSigningSecret))
+	fmt.Fprintf(mac, "%s:%s:", slackSignatureV0, timestamp)
+	mac.Write(body)
+	expected := slackSignatureV0 + "=" + hex.EncodeToString(mac.Sum(nil))
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// checkLegacyToken looks for the deprecated verification token in the request body.
+// Depending on the endpoint, it is sent as a form field, inside a form-encoded JSON
+// payload (interactive components), or as a field of a JSON body (Events API).
+func checkLegacyToken(body []byte) error {
+	var payload struct {
+		Token string
+	}
+	form, err := url.ParseQuery(string(body))
+	switch {
+	case err == nil && form.Get("token") != "":
+		payload.Token = form.Get("token")
+	case err == nil && form.Get("payload") != "":
+		json.Unmarshal([]byte(form.Get("payload")), &payload)
+	default:
+		json.Unmarshal(body, &payload)
+	}
+
+	if payload.Token == "" {
+		return fmt.Errorf("request has neither a signature nor a verification token")
+	}
+	if subtle.ConstantTimeCompare([]byte(payload.Token), []byte(config.SlackVerificationToken)) != 1 {
+		return fmt.Errorf("verification token did not match the configured one")
+	}
+	return nil
+}